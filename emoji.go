@@ -0,0 +1,290 @@
+package html2text
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+)
+
+// EmojiMode controls how emoji found in text are rendered.
+type EmojiMode int
+
+const (
+	// EmojiKeep leaves emoji untouched.
+	EmojiKeep EmojiMode = iota
+	// EmojiStrip removes emoji.
+	EmojiStrip
+	// EmojiShortcode replaces emoji with their ":name:" shortcode, keeping
+	// the ones without a known shortcode as they are.
+	EmojiShortcode
+)
+
+// emojiShortcodes maps common emoji, without variation selectors or skin tone
+// modifiers, to their shortcode names.
+var emojiShortcodes = map[string]string{
+	"\U0001F600": "grinning",
+	"\U0001F602": "joy",
+	"\U0001F603": "smiley",
+	"\U0001F604": "smile",
+	"\U0001F609": "wink",
+	"\U0001F60A": "blush",
+	"\U0001F60D": "heart_eyes",
+	"\U0001F60E": "sunglasses",
+	"\U0001F622": "cry",
+	"\U0001F62D": "sob",
+	"\U0001F642": "slightly_smiling_face",
+	"\U0001F644": "roll_eyes",
+	"\U0001F914": "thinking",
+	"\U0001F923": "rofl",
+	"\U0001F44B": "wave",
+	"\U0001F44C": "ok_hand",
+	"\U0001F44D": "+1",
+	"\U0001F44E": "-1",
+	"\U0001F44F": "clap",
+	"\U0001F440": "eyes",
+	"\U0001F4AF": "100",
+	"\U0001F525": "fire",
+	"\U0001F389": "tada",
+	"\U0001F680": "rocket",
+	"\U0001F64F": "pray",
+	"\U0001F4A1": "bulb",
+	"\U0001F4E7": "e-mail",
+	"\U0001F6A8": "rotating_light",
+	"\u2764":     "heart",
+	"\u2705":     "white_check_mark",
+	"\u274C":     "x",
+	"\u2728":     "sparkles",
+	"\u2B50":     "star",
+	"\u26A0":     "warning",
+	"\u2600":     "sunny",
+	"\u2614":     "umbrella",
+	"\u2615":     "coffee",
+}
+
+// emojiPresentation lists the characters displayed as emoji by default, per
+// the Emoji_Presentation property of the Unicode emoji data.
+var emojiPresentation = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x231A, 0x231B, 1}, {0x23E9, 0x23EC, 1}, {0x23F0, 0x23F0, 1},
+		{0x23F3, 0x23F3, 1}, {0x25FD, 0x25FE, 1}, {0x2614, 0x2615, 1},
+		{0x2648, 0x2653, 1}, {0x267F, 0x267F, 1}, {0x2693, 0x2693, 1},
+		{0x26A1, 0x26A1, 1}, {0x26AA, 0x26AB, 1}, {0x26BD, 0x26BE, 1},
+		{0x26C4, 0x26C5, 1}, {0x26CE, 0x26CE, 1}, {0x26D4, 0x26D4, 1},
+		{0x26EA, 0x26EA, 1}, {0x26F2, 0x26F3, 1}, {0x26F5, 0x26F5, 1},
+		{0x26FA, 0x26FA, 1}, {0x26FD, 0x26FD, 1}, {0x2705, 0x2705, 1},
+		{0x270A, 0x270B, 1}, {0x2728, 0x2728, 1}, {0x274C, 0x274C, 1},
+		{0x274E, 0x274E, 1}, {0x2753, 0x2755, 1}, {0x2757, 0x2757, 1},
+		{0x2795, 0x2797, 1}, {0x27B0, 0x27B0, 1}, {0x27BF, 0x27BF, 1},
+		{0x2B1B, 0x2B1C, 1}, {0x2B50, 0x2B50, 1}, {0x2B55, 0x2B55, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F004, 0x1F004, 1}, {0x1F0CF, 0x1F0CF, 1}, {0x1F18E, 0x1F18E, 1},
+		{0x1F191, 0x1F19A, 1}, {0x1F1E6, 0x1F1FF, 1}, {0x1F201, 0x1F201, 1},
+		{0x1F21A, 0x1F21A, 1}, {0x1F22F, 0x1F22F, 1}, {0x1F232, 0x1F236, 1},
+		{0x1F238, 0x1F23A, 1}, {0x1F250, 0x1F251, 1}, {0x1F300, 0x1F320, 1},
+		{0x1F32D, 0x1F335, 1}, {0x1F337, 0x1F37C, 1}, {0x1F37E, 0x1F393, 1},
+		{0x1F3A0, 0x1F3CA, 1}, {0x1F3CF, 0x1F3D3, 1}, {0x1F3E0, 0x1F3F0, 1},
+		{0x1F3F4, 0x1F3F4, 1}, {0x1F3F8, 0x1F43E, 1}, {0x1F440, 0x1F440, 1},
+		{0x1F442, 0x1F4FC, 1}, {0x1F4FF, 0x1F53D, 1}, {0x1F54B, 0x1F54E, 1},
+		{0x1F550, 0x1F567, 1}, {0x1F57A, 0x1F57A, 1}, {0x1F595, 0x1F596, 1},
+		{0x1F5A4, 0x1F5A4, 1}, {0x1F5FB, 0x1F64F, 1}, {0x1F680, 0x1F6C5, 1},
+		{0x1F6CC, 0x1F6CC, 1}, {0x1F6D0, 0x1F6D2, 1}, {0x1F6D5, 0x1F6D7, 1},
+		{0x1F6DC, 0x1F6DF, 1}, {0x1F6EB, 0x1F6EC, 1}, {0x1F6F4, 0x1F6FC, 1},
+		{0x1F7E0, 0x1F7EB, 1}, {0x1F7F0, 0x1F7F0, 1}, {0x1F90C, 0x1F93A, 1},
+		{0x1F93C, 0x1F945, 1}, {0x1F947, 0x1F9FF, 1}, {0x1FA70, 0x1FA7C, 1},
+		{0x1FA80, 0x1FA88, 1}, {0x1FA90, 0x1FABD, 1}, {0x1FABF, 0x1FAC5, 1},
+		{0x1FACE, 0x1FADB, 1}, {0x1FAE0, 0x1FAE8, 1}, {0x1FAF0, 0x1FAF8, 1},
+	},
+}
+
+// emojiText lists the emoji characters displayed as text by default, per the
+// Emoji property of the Unicode emoji data, such as "\u2764".  They are only
+// emoji when followed by a variation selector or a skin tone modifier.
+var emojiText = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1}, {0x00AE, 0x00AE, 1}, {0x203C, 0x203C, 1},
+		{0x2049, 0x2049, 1}, {0x2122, 0x2122, 1}, {0x2139, 0x2139, 1},
+		{0x2194, 0x2199, 1}, {0x21A9, 0x21AA, 1}, {0x2328, 0x2328, 1},
+		{0x23CF, 0x23CF, 1}, {0x23ED, 0x23EF, 1}, {0x23F1, 0x23F2, 1},
+		{0x23F8, 0x23FA, 1}, {0x24C2, 0x24C2, 1}, {0x25AA, 0x25AB, 1},
+		{0x25B6, 0x25B6, 1}, {0x25C0, 0x25C0, 1}, {0x25FB, 0x25FC, 1},
+		{0x2600, 0x2604, 1}, {0x260E, 0x260E, 1}, {0x2611, 0x2611, 1},
+		{0x2618, 0x2618, 1}, {0x261D, 0x261D, 1}, {0x2620, 0x2620, 1},
+		{0x2622, 0x2623, 1}, {0x2626, 0x2626, 1}, {0x262A, 0x262A, 1},
+		{0x262E, 0x262F, 1}, {0x2638, 0x263A, 1}, {0x2640, 0x2640, 1},
+		{0x2642, 0x2642, 1}, {0x265F, 0x2660, 1}, {0x2663, 0x2663, 1},
+		{0x2665, 0x2666, 1}, {0x2668, 0x2668, 1}, {0x267B, 0x267B, 1},
+		{0x267E, 0x267E, 1}, {0x2692, 0x2692, 1}, {0x2694, 0x2697, 1},
+		{0x2699, 0x2699, 1}, {0x269B, 0x269C, 1}, {0x26A0, 0x26A0, 1},
+		{0x26A7, 0x26A7, 1}, {0x26B0, 0x26B1, 1}, {0x26C8, 0x26C8, 1},
+		{0x26CF, 0x26CF, 1}, {0x26D1, 0x26D1, 1}, {0x26D3, 0x26D3, 1},
+		{0x26E9, 0x26E9, 1}, {0x26F0, 0x26F1, 1}, {0x26F4, 0x26F4, 1},
+		{0x26F7, 0x26F9, 1}, {0x2702, 0x2702, 1}, {0x2708, 0x2709, 1},
+		{0x270C, 0x270D, 1}, {0x270F, 0x270F, 1}, {0x2712, 0x2712, 1},
+		{0x2714, 0x2714, 1}, {0x2716, 0x2716, 1}, {0x271D, 0x271D, 1},
+		{0x2721, 0x2721, 1}, {0x2733, 0x2734, 1}, {0x2744, 0x2744, 1},
+		{0x2747, 0x2747, 1}, {0x2763, 0x2764, 1}, {0x27A1, 0x27A1, 1},
+		{0x2934, 0x2935, 1}, {0x2B05, 0x2B07, 1}, {0x3030, 0x3030, 1},
+		{0x303D, 0x303D, 1}, {0x3297, 0x3297, 1}, {0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F170, 0x1F171, 1}, {0x1F17E, 0x1F17F, 1}, {0x1F202, 0x1F202, 1},
+		{0x1F237, 0x1F237, 1}, {0x1F321, 0x1F321, 1}, {0x1F324, 0x1F32C, 1},
+		{0x1F336, 0x1F336, 1}, {0x1F37D, 0x1F37D, 1}, {0x1F396, 0x1F397, 1},
+		{0x1F399, 0x1F39B, 1}, {0x1F39E, 0x1F39F, 1}, {0x1F3CB, 0x1F3CE, 1},
+		{0x1F3D4, 0x1F3DF, 1}, {0x1F3F3, 0x1F3F3, 1}, {0x1F3F5, 0x1F3F5, 1},
+		{0x1F3F7, 0x1F3F7, 1}, {0x1F43F, 0x1F43F, 1}, {0x1F441, 0x1F441, 1},
+		{0x1F4FD, 0x1F4FD, 1}, {0x1F549, 0x1F54A, 1}, {0x1F56F, 0x1F570, 1},
+		{0x1F573, 0x1F579, 1}, {0x1F587, 0x1F587, 1}, {0x1F58A, 0x1F58D, 1},
+		{0x1F590, 0x1F590, 1}, {0x1F5A5, 0x1F5A5, 1}, {0x1F5A8, 0x1F5A8, 1},
+		{0x1F5B1, 0x1F5B2, 1}, {0x1F5BC, 0x1F5BC, 1}, {0x1F5C2, 0x1F5C4, 1},
+		{0x1F5D1, 0x1F5D3, 1}, {0x1F5DC, 0x1F5DE, 1}, {0x1F5E1, 0x1F5E1, 1},
+		{0x1F5E3, 0x1F5E3, 1}, {0x1F5E8, 0x1F5E8, 1}, {0x1F5EF, 0x1F5EF, 1},
+		{0x1F5F3, 0x1F5F3, 1}, {0x1F5FA, 0x1F5FA, 1}, {0x1F6CB, 0x1F6CB, 1},
+		{0x1F6CD, 0x1F6CF, 1}, {0x1F6E0, 0x1F6E5, 1}, {0x1F6E9, 0x1F6E9, 1},
+		{0x1F6F0, 0x1F6F0, 1}, {0x1F6F3, 0x1F6F3, 1},
+	},
+	LatinOffset: 2,
+}
+
+// isEmoji reports whether r is an emoji character, whatever its default
+// presentation.
+func isEmoji(r rune) bool {
+	return unicode.Is(emojiPresentation, r) || unicode.Is(emojiText, r)
+}
+
+// isSkinTone reports whether r is a skin tone modifier.
+func isSkinTone(r rune) bool {
+	return r >= 0x1F3FB && r <= 0x1F3FF
+}
+
+// isEmojiModifier reports whether r extends the emoji sequence preceding it:
+// variation selectors, skin tone modifiers, keycaps and tags.
+func isEmojiModifier(r rune) bool {
+	return r == 0xFE0E || r == 0xFE0F || r == 0x20E3 ||
+		isSkinTone(r) || (r >= 0xE0020 && r <= 0xE007F)
+}
+
+// isRegionalIndicator reports whether r is one half of a flag emoji.
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1F1E6 && r <= 0x1F1FF
+}
+
+// emojiSequenceLen returns the number of runes of the emoji sequence starting
+// at runes[i], or 0 if there is none.  Modifiers and zero width joiner
+// sequences are part of the sequence, so that they are handled as a unit.
+func emojiSequenceLen(runes []rune, i int) int {
+	r := runes[i]
+	switch {
+	case isRegionalIndicator(r):
+		if i+1 < len(runes) && isRegionalIndicator(runes[i+1]) {
+			return 2
+		}
+		return 1
+	case strings.ContainsRune("0123456789#*", r):
+		// Keycaps, e.g. "1️⃣".
+		j := i + 1
+		if j < len(runes) && runes[j] == 0xFE0F {
+			j++
+		}
+		if j < len(runes) && runes[j] == 0x20E3 {
+			return j + 1 - i
+		}
+		return 0
+	case unicode.Is(emojiPresentation, r):
+	case unicode.Is(emojiText, r) && i+1 < len(runes) && (runes[i+1] == 0xFE0F || isSkinTone(runes[i+1])):
+	default:
+		return 0
+	}
+
+	j := i + 1
+	for j < len(runes) {
+		if isEmojiModifier(runes[j]) {
+			j++
+		} else if runes[j] == 0x200D && j+1 < len(runes) && isEmoji(runes[j+1]) {
+			j += 2
+		} else {
+			break
+		}
+	}
+	return j - i
+}
+
+// emojiShortcode returns the ":name:" shortcode of an emoji sequence, or ""
+// when it is unknown.
+func emojiShortcode(sequence []rune) string {
+	key := make([]rune, 0, len(sequence))
+	for _, r := range sequence {
+		if r != 0xFE0F && r != 0xFE0E && !isSkinTone(r) {
+			key = append(key, r)
+		}
+	}
+	if name, ok := emojiShortcodes[string(key)]; ok {
+		return ":" + name + ":"
+	}
+	return ""
+}
+
+// convertEmoji renders the emoji found in text according to mode.
+func convertEmoji(text string, mode EmojiMode) string {
+	if mode == EmojiKeep {
+		return text
+	}
+	var (
+		buf   bytes.Buffer
+		runes = []rune(text)
+	)
+	for i := 0; i < len(runes); {
+		n := emojiSequenceLen(runes, i)
+		if n == 0 {
+			buf.WriteRune(runes[i])
+			i++
+			continue
+		}
+		if mode == EmojiShortcode {
+			if shortcode := emojiShortcode(runes[i : i+n]); shortcode != "" {
+				buf.WriteString(shortcode)
+			} else {
+				buf.WriteString(string(runes[i : i+n]))
+			}
+		}
+		i += n
+	}
+	return buf.String()
+}
+
+// graphemeLen returns the number of runes of the grapheme cluster, i.e. the
+// user-perceived character, starting at runes[i], so that emoji sequences,
+// such as flags and keycaps, and letters with combining marks are kept whole.
+// It is a simplification of the Unicode segmentation rules covering these
+// common cases.
+func graphemeLen(runes []rune, i int) int {
+	if n := emojiSequenceLen(runes, i); n > 0 {
+		return n
+	}
+	j := i + 1
+	for j < len(runes) && isGraphemeExtender(runes[j]) {
+		j++
+	}
+	return j - i
+}
+
+// isGraphemeExtender reports whether r extends the grapheme cluster preceding
+// it rather than starting a new one.
+func isGraphemeExtender(r rune) bool {
+	return r == 0x200D || isEmojiModifier(r) || unicode.In(r, unicode.Mn, unicode.Me)
+}
+
+// graphemeWidth returns the display width of a grapheme cluster.  Emoji
+// sequences are displayed as a single wide character, whatever the width of
+// their parts.
+func graphemeWidth(cluster []rune) int {
+	if len(cluster) > 1 && emojiSequenceLen(cluster, 0) == len(cluster) {
+		return 2
+	}
+	width := 0
+	for _, r := range cluster {
+		width += runeWidth(r)
+	}
+	return width
+}
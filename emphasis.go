@@ -0,0 +1,46 @@
+package html2text
+
+import "strings"
+
+// Starts of the ranges of the Unicode mathematical alphanumeric symbols used
+// by EmphasisUnicode.
+const (
+	boldUpper   = 0x1D400 // 𝐀
+	boldLower   = 0x1D41A // 𝐚
+	boldDigit   = 0x1D7CE // 𝟎
+	italicUpper = 0x1D434 // 𝐴
+	italicLower = 0x1D44E // 𝑎
+	// italicH is the italic "h", which lies outside of its range as it was
+	// already encoded as the Planck constant.
+	italicH = 0x210E // ℎ
+)
+
+// unicodeBold renders the ASCII letters and digits of text in bold.
+func unicodeBold(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'A' && r <= 'Z':
+			return boldUpper + r - 'A'
+		case r >= 'a' && r <= 'z':
+			return boldLower + r - 'a'
+		case r >= '0' && r <= '9':
+			return boldDigit + r - '0'
+		}
+		return r
+	}, text)
+}
+
+// unicodeItalic renders the ASCII letters of text in italic.
+func unicodeItalic(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == 'h':
+			return italicH
+		case r >= 'A' && r <= 'Z':
+			return italicUpper + r - 'A'
+		case r >= 'a' && r <= 'z':
+			return italicLower + r - 'a'
+		}
+		return r
+	}, text)
+}
@@ -2,56 +2,1004 @@ package html2text
 
 import (
 	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
+	"github.com/mattn/go-runewidth"
 	"github.com/olekukonko/tablewriter"
 	"github.com/ssor/bom"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/unicode/norm"
 )
 
 // Options provide toggles and overrides to control specific rendering behaviors.
 type Options struct {
 	PrettyTables bool // Turns on pretty ASCII rendering for table elements.
-	OmitLinks bool    // Turns on omitting links
+	OmitLinks    bool // Turns on omitting links
+	// ListAllOptions renders every <option> of a <select>, grouped under
+	// their <optgroup> labels, instead of only the selected one.
+	ListAllOptions bool
+	// Strict makes conversion fail with an error on malformed structures,
+	// such as table cells outside of a row or table rows of a different
+	// number of columns, instead of silently rendering them.
+	Strict bool
+	// ImagePlaceholder, when set, renders images (including standalone ones,
+	// which are otherwise skipped) using this format, where a single "%s" is
+	// replaced by the alt text, e.g. "[image: %s]".  Images without alt text render
+	// the format with the "%s" and its leading separator removed, e.g.
+	// "[image]".
+	ImagePlaceholder string
+	// OutputFilter, when set, is applied to the final text right before it is
+	// returned, after whitespace trimming and blank line collapsing.
+	OutputFilter func(string) string
+	// SummaryMarker is prepended to the <summary> line of a <details>
+	// element, e.g. "▸ ", to show it is a disclosure control.
+	SummaryMarker string
+	// ShowDataValues appends the machine-readable value of <data> elements
+	// in parentheses when it differs from the displayed text.
+	ShowDataValues bool
+	// MaxDepth, when positive, bounds how deeply nested the rendered document
+	// may be, returning ErrMaxDepthExceeded for deeper documents.
+	MaxDepth int
+	// IncludeComments renders HTML comments as "<!-- comment -->" instead of
+	// dropping them.
+	IncludeComments bool
+	// OrderedListDelimiter follows the number of ordered list items, e.g. ")"
+	// for "1) item".  Defaults to ".".
+	OrderedListDelimiter string
+	// HeadingIDs appends the id of headings as a reference marker, e.g.
+	// "Section Title [#section-title]", for rebuilding tables of contents.
+	HeadingIDs bool
+	// PreformattedSamp preserves whitespace in every <samp> element, like
+	// <pre>, rather than only in those containing block content.
+	PreformattedSamp bool
+	// EmojiMode controls whether emoji are kept (the default), stripped or
+	// replaced by their shortcodes.
+	EmojiMode EmojiMode
+	// RenderFontSize marks the content of legacy <font size> elements, e.g.
+	// "[size=5]big[/size]".
+	RenderFontSize bool
+	// DropUnsafeLinks omits the URL of links using the javascript:, vbscript:
+	// or data: schemes, only rendering their text.
+	DropUnsafeLinks bool
+	// NumberCaptions prefixes table and figure captions with an incrementing
+	// counter, e.g. "Table 1: " and "Figure 2: ".
+	NumberCaptions bool
+	// MaxInputBytes, when positive, bounds the size of the HTML read by
+	// FromReader and friends, returning ErrInputTooLarge for bigger inputs.
+	MaxInputBytes int64
+	// BlockquoteCitations appends the cite URL of blockquotes as their last
+	// quoted line, e.g. "> — https://source".
+	BlockquoteCitations bool
+	// BlockSeparator, when set, is inserted on its own line between
+	// consecutive block elements at the document root, e.g. "---".
+	BlockSeparator string
+	// ShowCaptionTracks notes the subtitle and caption tracks of <video> and
+	// <audio> elements, e.g. "[captions available: en, fr]".
+	ShowCaptionTracks bool
+	// LinkFormat, when set, renders links using this format, where the first
+	// "%s" is replaced by the link text and the second one by the URL, e.g.
+	// LinkFormatAngle.  A format with a single "%s" renders the URL alone, as
+	// do links without text.  Defaults to "text ( url )".
+	LinkFormat string
+	// OutputCharset is the character set, e.g. "windows-1252" or "shift_jis",
+	// that FromReaderToWriter encodes its output with.  Defaults to UTF-8.
+	OutputCharset string
+	// StrictOutputCharset makes FromReaderToWriter fail with an error on
+	// characters not representable in OutputCharset, instead of replacing
+	// them with "?".
+	StrictOutputCharset bool
+	// StripEmptyQuoteLines removes the blockquote lines made of nothing but
+	// the ">" prefix, or the one of BlockquoteMarker.
+	StripEmptyQuoteLines bool
+	// AbbrMode controls how the title of <abbr> and <acronym> elements is
+	// rendered: not at all (the default), inline after the abbreviation, or
+	// in a glossary appended to the document.
+	AbbrMode AbbrMode
+	// Normalization is the Unicode normalization form the text is put in.
+	// Defaults to NormalizationNone, leaving the text as is.
+	Normalization Normalization
+	// HeadingStyle controls how headings are rendered.  Defaults to
+	// HeadingDivider.
+	HeadingStyle HeadingStyle
+	// TableCSV renders tables as RFC 4180 CSV, with the header row first,
+	// instead of an ASCII grid.  It takes precedence over PrettyTables, and
+	// table captions are left out.
+	TableCSV bool
+	// ClassMarkers maps class names to the marker surrounding the content of
+	// the <span> elements having that class, e.g. "highlight" to "==" for
+	// "==highlighted==".  Other spans render transparently.
+	ClassMarkers map[string]string
+	// GlobalIndent prefixes every line of the output, e.g. "    " to indent
+	// it or "> " to quote it, stacking with blockquote prefixes.  Blank lines
+	// only get the indent with its trailing whitespace removed.
+	GlobalIndent string
+	// AnnotateDeletions follows struck <del> edits with their datetime, e.g.
+	// "~~removed~~ [deleted 2024-01-02]".
+	AnnotateDeletions bool
+	// LinkStyle controls where link URLs are rendered.  Defaults to
+	// LinkInline.
+	LinkStyle LinkStyle
+	// KeepBidiControls keeps the Unicode bidirectional formatting characters,
+	// such as LRM and RLM, which are otherwise stripped from the output.
+	KeepBidiControls bool
+	// SemanticOnly flattens chains of presentational <div> and <span>
+	// wrappers, each only containing the next, rendering them as a single
+	// <div>.  This also keeps deeply wrapped content within MaxDepth.
+	SemanticOnly bool
+	// HeadingDividers sets the divider glyph of headings per level, from 1
+	// for <h1> to 6 for <h6>, with the HeadingDivider style, e.g. "=" for
+	// level 1.  An empty glyph means no divider.  Levels not set keep their
+	// default: "*" for <h1>, "-" for <h2> and <h3>, none below.
+	HeadingDividers map[int]string
+	// OutputElementFormat, when set, renders the result of <output> elements
+	// using this format, where a single "%s" is replaced by the result, e.g.
+	// "= %s" or "[%s]".  A format without "%s" is a prefix of the result.
+	OutputElementFormat string
+	// IncludeNoscript replaces lazy-loading placeholder images, i.e. with no
+	// src or a "data:" one, by the image of the <noscript> element following
+	// them.  By default, both are rendered.
+	IncludeNoscript bool
+	// PadInlineMarkers separates emphasized and code runs, such as "*bold*"
+	// or "~~struck~~", from adjacent words by a single space, even when the
+	// source has none, e.g. "foo<b>bar</b>baz" renders as "foo *bar* baz"
+	// rather than "foo*bar*baz".  Punctuation stays glued to them.
+	PadInlineMarkers bool
+	// ClearBreakParagraphs renders the legacy <br clear="all"> float
+	// clearing line breaks as paragraph breaks, which is often their visual
+	// intent, rather than as single line breaks.
+	ClearBreakParagraphs bool
+	// ParagraphSpacing is the number of newlines separating paragraphs,
+	// lists, headings, tables and similar blocks from the surrounding
+	// content, longer runs of newlines being collapsed to it.  Defaults to 2,
+	// i.e. a blank line, while 1 yields compact output.
+	ParagraphSpacing int
+	// MergeHeaderRows flattens tables with several rows of column headers,
+	// such as a row of colspan groups above a row of sub-columns, into a
+	// single header row combining the labels of each column, e.g. "Group /
+	// Sub".
+	MergeHeaderRows bool
+	// GenerateTOC prepends a table of contents to the output, listing the
+	// headings indented by level.
+	GenerateTOC bool
+	// LinkDisplay controls which part of the URLs is displayed after the
+	// link text.  Defaults to LinkDisplayFull.
+	LinkDisplay LinkDisplay
+	// BlockquoteMarker is the prefix of blockquote lines, e.g. "| ", or "  "
+	// to only indent them.  Nested blockquotes repeat it, not counting its
+	// trailing whitespace unless it is made of nothing else, e.g. "|| " or
+	// "    ".  Defaults to "> ".
+	BlockquoteMarker string
+	// AlwaysShowLinkURL renders the URL of links even when the link text is
+	// the URL itself, e.g. "http://example.com/ ( http://example.com/ )",
+	// for the sake of machine post-processing.  By default, such duplicates
+	// are left out.
+	AlwaysShowLinkURL bool
+	// EmphasisStyle controls how bold and italic text is rendered.  Defaults
+	// to EmphasisMarkers.
+	EmphasisStyle EmphasisStyle
+	// Debug annotates the output with the elements producing it, e.g.
+	// "[p]text[/p]", to diagnose conversions.  It is meant for development
+	// only.
+	Debug bool
+	// ImageTitle controls whether the title of images is rendered along with
+	// or instead of their alt text.  Defaults to ImageTitleIgnore.
+	ImageTitle ImageTitle
+	// DefinitionListStyle controls how <dl> definition lists are rendered.
+	// Defaults to DefinitionListBlock.
+	DefinitionListStyle DefinitionListStyle
+	// ButtonLinks renders the text of call to action links styled as
+	// buttons, i.e. with a role="button" or a class containing "btn", within
+	// brackets to make them stand out, e.g. "[ Sign Up ] ( url )".
+	ButtonLinks bool
+	// PlainTableRowSeparator lays the tables rendered without PrettyTables
+	// or TableCSV out with one row per line, the cells being padded to the
+	// width of their column, and the rows separated by a line of the
+	// separator repeated across the table, e.g. "-", or "-" if it has no
+	// width.  By default, the cells of such tables simply run on.
+	PlainTableRowSeparator string
+	// StripQuoteDecoration renders blockquotes as plain paragraphs, without
+	// the BlockquoteMarker prefix of their lines nor their wrapping, e.g. to
+	// feed summarizers.  Inline <q> quotations are always rendered without
+	// quote marks.
+	StripQuoteDecoration bool
+	// TrackedChanges renders <del> and <ins> edits in the tracked change
+	// notation of wdiff, e.g. "[-old-]" and "[+new+]", a deletion directly
+	// followed by an insertion reading as a replacement, "[-old-][+new+]".
+	// By default, deletions are struck and insertions left unmarked.
+	TrackedChanges bool
+	// TableMaxWidth, when set, is the maximum width of the tables rendered
+	// with PrettyTables.  The columns of wider tables are narrowed in
+	// proportion to their width, their cells being wrapped to fit.
+	TableMaxWidth int
+	// StyleEmphasis renders the <span> elements emphasized by their inline
+	// style like the equivalent elements: "font-weight: bold" like <b>,
+	// "font-style: italic" like <i> and "text-decoration: line-through" like
+	// <s>.  Underlines are left unmarked, like <u>.
+	StyleEmphasis bool
+	// QuoteBlankLines is the maximum number of consecutive blank quoted
+	// lines, made of the blockquote prefix only, as nested quotes pile them
+	// up.  Defaults to 1, while a negative value keeps them all.
+	QuoteBlankLines int
+	// TableCaptionsBelow places the captions of tables below them rather
+	// than above, unless their caption-side style, or the one of their
+	// table, says otherwise.  Either way, "caption-side: bottom" places a
+	// caption below its table.
+	TableCaptionsBelow bool
+	// TrailingNewline ends the output, unless empty, with a single newline,
+	// e.g. to concatenate outputs.  By default, the output has no trailing
+	// whitespace.
+	TrailingNewline bool
+	// TaskLists renders the items of task lists, starting with a checkbox,
+	// with a "[x] " or "[ ] " marker, depending on whether it is checked,
+	// instead of their bullet or number.
+	TaskLists bool
+	// FormattingCharacters controls whether the typographic spaces, such as
+	// &ensp;, &emsp; and &thinsp;, and the joiners, such as &zwnj; and
+	// &zwj;, are kept, normalized or stripped.  By default, spaces become
+	// regular spaces and joiners, which are meaningful in scripts such as
+	// Persian or Devanagari, are kept.
+	FormattingCharacters FormattingCharacters
+	// BlockquoteStyle controls whether nested blockquotes stack their
+	// markers, e.g. ">> ", (the default) or are indented by four spaces per
+	// level with a single marker, e.g. "    > ".
+	BlockquoteStyle BlockquoteStyle
+	// StruckPrices renders struck out prices, as found in sales, followed by
+	// "(was)" instead of strikethrough markers, e.g. "<s>$100</s> $80"
+	// becomes "$100 (was) $80".
+	StruckPrices bool
+	// CellParagraphSpacing is the number of newlines separating paragraphs
+	// and other blocks within table cells.  Defaults to 1, keeping cells
+	// compact, while 2 separates them by blank lines.
+	CellParagraphSpacing int
+	// SuppressTitles ignores the title attribute of every element, turning
+	// off the title-based annotations, such as the expansions of
+	// abbreviations and the titles of images, for the cleanest prose.
+	SuppressTitles bool
+	// PictureViewportWidth is the width, in CSS pixels, of the viewport
+	// against which the media queries of the <source> elements of <picture>
+	// elements are matched when picking the URL of their image, as returned
+	// by FromReaderStructured.  By default, the source without media query is
+	// picked.  Either way, the <img> src is the fallback.
+	PictureViewportWidth int
+}
+
+// LinkStyle is a style of rendering links.
+type LinkStyle int
+
+const (
+	// LinkInline renders URLs after the link text, e.g. "text ( url )", or
+	// as set by Options.LinkFormat.
+	LinkInline LinkStyle = iota
+	// LinkNumberedInline only marks the link text with the number of the
+	// link, e.g. "text[1]", leaving the URLs to the links returned by
+	// FromStringWithLinks.
+	LinkNumberedInline
+)
+
+// DefinitionListStyle is a style of rendering definition lists.
+type DefinitionListStyle int
+
+const (
+	// DefinitionListBlock renders terms and definitions on their own lines,
+	// definitions being indented.
+	DefinitionListBlock DefinitionListStyle = iota
+	// DefinitionListInline renders each term along with its definition on a
+	// single line, e.g. "Term: definition".
+	DefinitionListInline
+)
+
+// ImageTitle controls how the title of images is rendered.
+type ImageTitle int
+
+const (
+	// ImageTitleIgnore only renders the alt text of images.
+	ImageTitleIgnore ImageTitle = iota
+	// ImageTitlePrefer renders the title of images instead of their alt
+	// text, falling back to it.
+	ImageTitlePrefer
+	// ImageTitleAppend renders the title of images after their alt text,
+	// e.g. "Alt (Title)".
+	ImageTitleAppend
+)
+
+// LinkDisplay controls which part of link URLs is displayed.
+type LinkDisplay int
+
+const (
+	// LinkDisplayFull displays the full URL, e.g. "( https://example.com/a/b )".
+	LinkDisplayFull LinkDisplay = iota
+	// LinkDisplayDomainOnly only displays the host of the URL, e.g.
+	// "( example.com )".  URLs without a host, such as relative or mailto:
+	// ones, are displayed in full.
+	LinkDisplayDomainOnly
+)
+
+// EmphasisStyle is a style of rendering emphasized text.
+type EmphasisStyle int
+
+const (
+	// EmphasisMarkers surrounds bold text with "*" markers, leaving italic
+	// text as is.
+	EmphasisMarkers EmphasisStyle = iota
+	// EmphasisUnicode renders bold and italic text with the Unicode
+	// mathematical alphanumeric symbols, e.g. "𝐛𝐨𝐥𝐝" and "𝑖𝑡𝑎𝑙𝑖𝑐", for
+	// contexts such as social media or chat.  Only ASCII letters and, in
+	// bold, digits are styled.
+	EmphasisUnicode
+)
+
+// HeadingStyle is a style of rendering headings.
+type HeadingStyle int
+
+const (
+	// HeadingDivider surrounds <h1> and <h2> headings with "*" and "-"
+	// dividers respectively, and underlines <h3> headings with "-".
+	HeadingDivider HeadingStyle = iota
+	// HeadingUppercase uppercases <h1> to <h3> headings.
+	HeadingUppercase
+	// HeadingMarkdown prefixes headings with "#" marks, one per level, e.g.
+	// "## Section".
+	HeadingMarkdown
+	// HeadingPlain renders <h1> to <h3> headings as plain text.
+	HeadingPlain
+)
+
+// Normalization is a Unicode normalization form.
+type Normalization int
+
+const (
+	// NormalizationNone leaves the text as is.
+	NormalizationNone Normalization = iota
+	// NormalizationNFC composes characters, e.g. "e" followed by a combining
+	// acute accent becomes "é".
+	NormalizationNFC
+	// NormalizationNFKC composes characters and also folds compatibility
+	// characters, e.g. fullwidth "Ａ" becomes "A" and "ﬁ" becomes "fi".
+	NormalizationNFKC
+)
+
+// AbbrMode controls how abbreviation titles are rendered.
+type AbbrMode int
+
+const (
+	// AbbrKeep only renders the abbreviation itself.
+	AbbrKeep AbbrMode = iota
+	// AbbrInline expands abbreviations inline, e.g. "HTML (HyperText Markup
+	// Language)".
+	AbbrInline
+	// AbbrGlossary appends the abbreviations and their titles, in order of
+	// appearance, to the document under an "Abbreviations:" section.
+	AbbrGlossary
+)
+
+// FormattingCharacters controls how typographic spaces and joiners are
+// rendered.
+type FormattingCharacters int
+
+const (
+	// FormattingNormalize replaces typographic spaces with regular spaces,
+	// keeping joiners.
+	FormattingNormalize FormattingCharacters = iota
+	// FormattingKeep leaves typographic spaces and joiners untouched.
+	FormattingKeep
+	// FormattingStrip strips both typographic spaces and joiners.
+	FormattingStrip
+)
+
+// BlockquoteStyle is a style of rendering nested blockquotes.
+type BlockquoteStyle int
+
+const (
+	// BlockquoteStacked repeats the marker of blockquotes at each level of
+	// nesting, e.g. ">> ".
+	BlockquoteStacked BlockquoteStyle = iota
+	// BlockquoteIndent indents nested blockquotes by four spaces per level,
+	// keeping a single marker, e.g. "    > ".
+	BlockquoteIndent
+)
+
+// Presets for Options.LinkFormat.
+const (
+	LinkFormatAngle    = "%s <%s>"  // "text <url>"
+	LinkFormatMarkdown = "[%s](%s)" // "[text](url)"
+	LinkFormatURLOnly  = "<%s>"     // "<url>", dropping the link text.
+)
+
+// stripBidiControl maps the bidirectional formatting characters to -1 for
+// strings.Map to drop them.
+func stripBidiControl(r rune) rune {
+	switch {
+	case r == '\u200E' || r == '\u200F': // LRM, RLM.
+		return -1
+	case r >= '\u202A' && r <= '\u202E': // LRE, RLE, PDF, LRO, RLO.
+		return -1
+	case r >= '\u2066' && r <= '\u2069': // LRI, RLI, FSI, PDI.
+		return -1
+	}
+	return r
+}
+
+// ErrMaxDepthExceeded is returned when a document is nested more deeply than
+// allowed by Options.MaxDepth.
+var ErrMaxDepthExceeded = errors.New("html2text: maximum document depth exceeded")
+
+// ErrInputTooLarge is returned when the HTML input is bigger than allowed by
+// Options.MaxInputBytes.
+var ErrInputTooLarge = errors.New("html2text: input exceeds maximum size")
+
+// ErrNoSelectorMatch is returned by FromReaderSelector when no element
+// matches the selector.
+var ErrNoSelectorMatch = errors.New("html2text: no element matches the selector")
+
+// OutlineItem is a heading of the document outline.
+type OutlineItem struct {
+	Level int    `json:"level"` // Heading level, from 1 for <h1> to 6 for <h6>.
+	Text  string `json:"text"`  // Heading text.
+}
+
+// Document is the structure of a document, as returned along with its text by
+// FromReaderStructured.  It is meant to be serialized to JSON.
+type Document struct {
+	Headings []OutlineItem `json:"headings"` // In document order.
+	Links    []string      `json:"links"`    // URLs of the rendered links.
+	Tables   [][][]string  `json:"tables"`   // As returned by FromReaderWithTables.
+	Images   []Image       `json:"images"`   // In document order.
+}
+
+// Image is an image of a document.
+type Image struct {
+	Src   string `json:"src"`
+	Alt   string `json:"alt,omitempty"`
+	Title string `json:"title,omitempty"`
+}
+
+// OpenGraph is the Open Graph data of a document, as found in the
+// <meta property="og:*"> elements of its head.
+type OpenGraph struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	Image       string `json:"image,omitempty"`
+	URL         string `json:"url,omitempty"`
+	Type        string `json:"type,omitempty"`
 }
 
 // FromHTMLNode renders text output from a pre-parsed HTML document.
 func FromHTMLNode(doc *html.Node, o ...Options) (string, error) {
+	text, _, err := fromHTMLNode(doc, o...)
+	return text, err
+}
+
+// fromHTMLNode renders text output from a pre-parsed HTML document, also
+// returning the data collected while rendering it.
+func fromHTMLNode(doc *html.Node, o ...Options) (string, *documentState, error) {
+	return renderHTMLNode(doc, &documentState{}, o...)
+}
+
+// renderHTMLNode is fromHTMLNode collecting the data into state, whose flags
+// select the optional data to collect, e.g. recordTables.
+func renderHTMLNode(doc *html.Node, state *documentState, o ...Options) (string, *documentState, error) {
 	var options Options
 	if len(o) > 0 {
 		options = o[0]
 	}
 
+	state.outline = []OutlineItem{}
+	state.captionCounts = map[string]int{}
 	ctx := textifyTraverseContext{
 		buf:     bytes.Buffer{},
 		options: options,
+		doc:     state,
+	}
+	text, err := ctx.render(doc)
+	if err != nil {
+		return "", nil, err
+	}
+	if glossary := ctx.doc.glossary(); glossary != "" {
+		text = strings.TrimSpace(text + "\n\n" + glossary)
+	}
+	if options.GenerateTOC {
+		if toc := ctx.doc.toc(); toc != "" {
+			text = strings.TrimSpace(toc + "\n\n" + text)
+		}
+	}
+	if !options.KeepBidiControls {
+		text = strings.Map(stripBidiControl, text)
 	}
-	if err := ctx.traverse(doc); err != nil {
+	switch options.Normalization {
+	case NormalizationNFC:
+		text = norm.NFC.String(text)
+	case NormalizationNFKC:
+		text = norm.NFKC.String(text)
+	}
+	if options.GlobalIndent != "" && text != "" {
+		lines := strings.Split(text, "\n")
+		for i, line := range lines {
+			if line == "" {
+				lines[i] = strings.TrimRight(options.GlobalIndent, " \t")
+			} else {
+				lines[i] = options.GlobalIndent + line
+			}
+		}
+		text = strings.Join(lines, "\n")
+	}
+	if options.TrailingNewline && text != "" {
+		text += "\n"
+	}
+	if options.OutputFilter != nil {
+		text = options.OutputFilter(text)
+	}
+	return text, ctx.doc, nil
+}
+
+// render traverses node and returns its text without applying any of the
+// final output processing, so it can also be used for fragments such as
+// table cells.
+func (ctx *textifyTraverseContext) render(node *html.Node) (string, error) {
+	if err := ctx.traverse(node); err != nil {
 		return "", err
 	}
+	return ctx.finish(), nil
+}
+
+// finish returns the text rendered so far, its blank lines trimmed.
+func (ctx *textifyTraverseContext) finish() string {
+	text := ctx.buf.String()
+	if ctx.options.StripEmptyQuoteLines {
+		text = ctx.emptyQuoteLineRe().ReplaceAllString(text, "")
+	} else if ctx.options.QuoteBlankLines >= 0 {
+		text = ctx.capQuoteBlankLines(text)
+	}
+	return trimBlankLines(text)
+}
 
-	text := strings.TrimSpace(newlineRe.ReplaceAllString(
-		strings.Replace(ctx.buf.String(), "\n ", "\n", -1), "\n\n"),
+// collapseNewlines shortens the runs of more than n newlines in text to n.
+func collapseNewlines(text string, n int) string {
+	var (
+		buf bytes.Buffer
+		run int
 	)
-	return text, nil
+	for _, r := range text {
+		if r != '\n' {
+			run = 0
+		} else if run++; run > n {
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// trimBlankLines removes the leading and trailing blank lines of text, along
+// with its trailing whitespace.  The indentation of the first line is kept, as
+// it can only come from preformatted content or from indented blocks, see
+// emit.
+func trimBlankLines(text string) string {
+	text = strings.TrimRightFunc(text, unicode.IsSpace)
+	content := strings.TrimLeftFunc(text, unicode.IsSpace)
+	indent := text[:len(text)-len(content)]
+	if i := strings.LastIndexByte(indent, '\n'); i >= 0 {
+		indent = indent[i+1:]
+	}
+	return indent + content
 }
 
 // FromReader renders text output after parsing HTML for the specified
 // io.Reader.
 func FromReader(reader io.Reader, options ...Options) (string, error) {
-	newReader, err := bom.NewReaderWithoutBom(reader)
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", err
+	}
+	return FromHTMLNode(doc, options...)
+}
+
+// FromReaderToWriter renders text output after parsing HTML for the specified
+// io.Reader, and writes it to w encoded with options.OutputCharset.
+func FromReaderToWriter(w io.Writer, reader io.Reader, options ...Options) error {
+	text, err := FromReader(reader, options...)
+	if err != nil {
+		return err
+	}
+	if len(options) > 0 && options[0].OutputCharset != "" {
+		if text, err = encodeOutput(text, options[0]); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(w, text)
+	return err
+}
+
+// encodeOutput encodes text with options.OutputCharset.
+func encodeOutput(text string, options Options) (string, error) {
+	enc, err := htmlindex.Get(options.OutputCharset)
+	if err != nil {
+		return "", fmt.Errorf("html2text: unknown output charset %q", options.OutputCharset)
+	}
+	if name, _ := htmlindex.Name(enc); name == "utf-8" {
+		return text, nil
+	}
+	encoder := enc.NewEncoder()
+	if encoded, err := encoder.String(text); err == nil || options.StrictOutputCharset {
+		return encoded, err
+	}
+	// Encode rune by rune to replace the unrepresentable ones.
+	var buf bytes.Buffer
+	for _, r := range text {
+		encoded, err := encoder.String(string(r))
+		if err != nil {
+			encoded = "?"
+		}
+		buf.WriteString(encoded)
+	}
+	return buf.String(), nil
+}
+
+// FromReaderWithOutline renders text output after parsing HTML for the
+// specified io.Reader, also returning the outline made of the headings
+// encountered.
+func FromReaderWithOutline(reader io.Reader, options ...Options) (string, []OutlineItem, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", nil, err
+	}
+	text, state, err := fromHTMLNode(doc, options...)
+	if err != nil {
+		return "", nil, err
+	}
+	return text, state.outline, nil
+}
+
+// FromReaderWithHighlights renders text output after parsing HTML for the
+// specified io.Reader, also returning the text of the highlighted <mark>
+// elements, such as the matches of search results, in document order.
+// Repeated highlights are all returned.
+func FromReaderWithHighlights(reader io.Reader, options ...Options) (string, []string, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", nil, err
+	}
+	text, state, err := fromHTMLNode(doc, options...)
+	if err != nil {
+		return "", nil, err
+	}
+	highlights := state.highlights
+	if highlights == nil {
+		highlights = []string{}
+	}
+	return text, highlights, nil
+}
+
+// FromReaderWithTables renders text output after parsing HTML for the
+// specified io.Reader, also returning the data of every table, nested ones
+// included, in document order.  Each table is made of its rows, the header
+// and footer rows being the first and last ones, each row being made of the
+// text of its cells.
+func FromReaderWithTables(reader io.Reader, options ...Options) (string, [][][]string, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", nil, err
+	}
+	text, state, err := renderHTMLNode(doc, &documentState{recordTables: true}, options...)
+	if err != nil {
+		return "", nil, err
+	}
+	tables := state.tables
+	if tables == nil {
+		tables = [][][]string{}
+	}
+	return text, tables, nil
+}
+
+// FromReaderStructured renders text output after parsing HTML for the
+// specified io.Reader, also returning the structure of the document: its
+// headings, links, tables and images.  The text is the same as the one
+// rendered by FromReader.
+func FromReaderStructured(reader io.Reader, options ...Options) (string, Document, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", Document{}, err
+	}
+	text, state, err := renderHTMLNode(doc, &documentState{recordTables: true}, options...)
+	if err != nil {
+		return "", Document{}, err
+	}
+	tables := state.tables
+	if tables == nil {
+		tables = [][][]string{}
+	}
+
+	links := state.links
+	if links == nil {
+		links = []string{}
+	}
+	images := state.images
+	if images == nil {
+		images = []Image{}
+	}
+	return text, Document{Headings: state.outline, Links: links, Tables: tables, Images: images}, nil
+}
+
+// FromReaderWithMicrodata renders text output after parsing HTML for the
+// specified io.Reader, also returning the values of the microdata properties,
+// keyed by their itemprop name.  Properties of nested items are flattened with
+// dotted keys, e.g. "author.name", and repeated properties keep their first
+// value.
+func FromReaderWithMicrodata(reader io.Reader, options ...Options) (string, map[string]string, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", nil, err
+	}
+	text, err := FromHTMLNode(doc, options...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	props := map[string]string{}
+	var walk func(node *html.Node, prefix string)
+	walk = func(node *html.Node, prefix string) {
+		childPrefix := prefix
+		if node.Type == html.ElementNode && hasAttr(node, "itemprop") {
+			names := strings.Fields(getAttrVal(node, "itemprop"))
+			for _, name := range names {
+				if _, ok := props[prefix+name]; !ok && !hasAttr(node, "itemscope") {
+					props[prefix+name] = microdataValue(node)
+				}
+			}
+			if hasAttr(node, "itemscope") && len(names) > 0 {
+				childPrefix = prefix + names[0] + "."
+			}
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			walk(c, childPrefix)
+		}
+	}
+	walk(doc, "")
+	return text, props, nil
+}
+
+// microdataValue returns the value of a microdata property element, taken
+// from the attribute holding it for elements such as <meta> or <a>, or else
+// from its text.
+func microdataValue(node *html.Node) string {
+	attrName := ""
+	switch node.DataAtom {
+	case atom.Meta:
+		attrName = "content"
+	case atom.A, atom.Area, atom.Link:
+		attrName = "href"
+	case atom.Audio, atom.Embed, atom.Iframe, atom.Img, atom.Source, atom.Track, atom.Video:
+		attrName = "src"
+	case atom.Object:
+		attrName = "data"
+	case atom.Data, atom.Meter:
+		attrName = "value"
+	case atom.Time:
+		if hasAttr(node, "datetime") {
+			attrName = "datetime"
+		}
+	}
+	if attrName != "" {
+		return strings.TrimSpace(getAttrVal(node, attrName))
+	}
+	return textContent(node)
+}
+
+// FromReaderWithOpenGraph renders text output after parsing HTML for the
+// specified io.Reader, also returning its Open Graph data, e.g. to generate
+// link previews.  Repeated properties keep their first value, while missing
+// ones are left empty.
+func FromReaderWithOpenGraph(reader io.Reader, options ...Options) (string, OpenGraph, error) {
+	doc, err := parseReader(reader, options)
+	if err != nil {
+		return "", OpenGraph{}, err
+	}
+	text, err := FromHTMLNode(doc, options...)
+	if err != nil {
+		return "", OpenGraph{}, err
+	}
+
+	var og OpenGraph
+	head := findElement(doc, atom.Head)
+	if head == nil {
+		return text, og, nil
+	}
+	fields := map[string]*string{
+		"og:title":       &og.Title,
+		"og:description": &og.Description,
+		"og:image":       &og.Image,
+		"og:image:url":   &og.Image,
+		"og:url":         &og.URL,
+		"og:type":        &og.Type,
+	}
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Meta {
+			property := strings.ToLower(strings.TrimSpace(getAttrVal(node, "property")))
+			if field, ok := fields[property]; ok && *field == "" {
+				*field = strings.TrimSpace(getAttrVal(node, "content"))
+			}
+		}
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(head)
+	return text, og, nil
+}
+
+// FromReaderSelector renders text output after parsing HTML for the specified
+// io.Reader, only rendering the first element matching selector.  Selectors
+// are simple CSS selectors made of a tag name, an id and classes, e.g. "main",
+// "#content" or "div.post.featured".
+func FromReaderSelector(reader io.Reader, selector string, options ...Options) (string, error) {
+	sel, err := parseSelector(selector)
 	if err != nil {
 		return "", err
 	}
-	doc, err := html.Parse(newReader)
+	doc, err := parseReader(reader, options)
 	if err != nil {
 		return "", err
 	}
-	return FromHTMLNode(doc, options...)
+	node := sel.find(doc)
+	if node == nil {
+		return "", ErrNoSelectorMatch
+	}
+	return FromHTMLNode(node, options...)
+}
+
+// parseReader parses the HTML document read from reader, skipping any BOM.
+// Concatenated documents, such as "<html>...</html><html>...</html>", are
+// parsed apart and merged into a single document with one <body> per
+// document, as the parser would otherwise run their content together.  Only
+// input which may hold several documents is tokenized to split them.
+func parseReader(reader io.Reader, options []Options) (*html.Node, error) {
+	if len(options) > 0 && options[0].MaxInputBytes > 0 {
+		reader = &limitedReader{
+			r: io.LimitReader(reader, options[0].MaxInputBytes+1),
+			n: options[0].MaxInputBytes,
+		}
+	}
+	newReader, err := bom.NewReaderWithoutBom(reader)
+	if err != nil {
+		return nil, err
+	}
+	input, err := io.ReadAll(newReader)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasSecondRoot(input) {
+		return html.Parse(bytes.NewReader(input))
+	}
+	documents := splitDocuments(input)
+	doc, err := html.Parse(bytes.NewReader(documents[0]))
+	if err != nil {
+		return nil, err
+	}
+	for _, document := range documents[1:] {
+		next, err := html.Parse(bytes.NewReader(document))
+		if err != nil {
+			return nil, err
+		}
+		mergeDocument(doc, next)
+	}
+	return doc, nil
+}
+
+// hasSecondRoot quickly reports whether input may hold concatenated
+// documents, i.e. has what looks like a <!DOCTYPE> or an <html> start tag
+// following a </body> or </html> end tag.  Unlike splitDocuments, it doesn't
+// tokenize input, so that it may also match within comments or scripts.
+func hasSecondRoot(input []byte) bool {
+	hasPrefix := func(b []byte, prefix string) bool {
+		return len(b) >= len(prefix) && bytes.EqualFold(b[:len(prefix)], []byte(prefix))
+	}
+	closed := false
+	for tag := input; ; tag = tag[1:] {
+		i := bytes.IndexByte(tag, '<')
+		if i < 0 {
+			return false
+		}
+		tag = tag[i:]
+		switch {
+		case hasPrefix(tag, "</body") || hasPrefix(tag, "</html"):
+			closed = true
+		case closed && (hasPrefix(tag, "<html") || hasPrefix(tag, "<!doctype")):
+			return true
+		}
+	}
+}
+
+// splitDocuments splits input before each document concatenated to a previous
+// one, i.e. before a <!DOCTYPE> or an <html> start tag following a </body> or
+// </html> end tag.  Other content following such end tags, which browsers
+// ignore, still belongs to the document.
+func splitDocuments(input []byte) [][]byte {
+	var (
+		documents     [][]byte
+		start, offset int
+		closed        bool
+	)
+	z := html.NewTokenizer(bytes.NewReader(input))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		raw := z.Raw()
+		size := len(raw)
+		switch tt {
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			if a := atom.Lookup(name); a == atom.Body || a == atom.Html {
+				closed = true
+			}
+		case html.DoctypeToken:
+			if closed {
+				documents = append(documents, input[start:offset])
+				start = offset
+			}
+			closed = false
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			if closed && atom.Lookup(name) == atom.Html {
+				documents = append(documents, input[start:offset])
+				start = offset
+			}
+			closed = false
+		case html.TextToken:
+			if len(bytes.TrimSpace(raw)) > 0 {
+				closed = false
+			}
+		}
+		offset += size
+	}
+	return append(documents, input[start:])
+}
+
+// mergeDocument moves the content of the next document into doc, the content
+// of its head going to the head of doc and its body following the bodies of
+// doc.
+func mergeDocument(doc, next *html.Node) {
+	root, head := findElement(doc, atom.Html), findElement(doc, atom.Head)
+	nextRoot := findElement(next, atom.Html)
+	if root == nil || head == nil || nextRoot == nil {
+		return
+	}
+	for c := nextRoot.FirstChild; c != nil; c = nextRoot.FirstChild {
+		nextRoot.RemoveChild(c)
+		if c.DataAtom != atom.Head {
+			root.AppendChild(c)
+			continue
+		}
+		for h := c.FirstChild; h != nil; h = c.FirstChild {
+			c.RemoveChild(h)
+			head.AppendChild(h)
+		}
+	}
+}
+
+// limitedReader reads from r, failing with ErrInputTooLarge once more than n
+// bytes have been read.
+type limitedReader struct {
+	r io.Reader
+	n int64 // Remaining bytes allowed.
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.n -= int64(n); l.n < 0 {
+		return n, ErrInputTooLarge
+	}
+	return n, err
 }
 
 // FromString parses HTML from the input string, then renders the text form.
@@ -64,9 +1012,53 @@ func FromString(input string, options ...Options) (string, error) {
 	return text, nil
 }
 
+// FromStringWithLinks renders text output from the input string, also
+// returning the URLs of the rendered links in order.  With the
+// LinkNumberedInline style, the link marked "[n]" is at index n-1.
+func FromStringWithLinks(input string, options ...Options) (string, []string, error) {
+	doc, err := parseReader(bytes.NewReader(bom.CleanBom([]byte(input))), options)
+	if err != nil {
+		return "", nil, err
+	}
+	text, state, err := fromHTMLNode(doc, options...)
+	if err != nil {
+		return "", nil, err
+	}
+	links := state.links
+	if links == nil {
+		links = []string{}
+	}
+	return text, links, nil
+}
+
+// FromStringFragment parses the input string as an HTML fragment, as found
+// within a <body>, then renders the text form.  Unlike FromString, no
+// html/head/body document structure is synthesized around the input.
+func FromStringFragment(input string, options ...Options) (string, error) {
+	if len(options) > 0 && options[0].MaxInputBytes > 0 && int64(len(input)) > options[0].MaxInputBytes {
+		return "", ErrInputTooLarge
+	}
+	bs := bom.CleanBom([]byte(input))
+	nodes, err := html.ParseFragment(bytes.NewReader(bs), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+	doc := &html.Node{Type: html.DocumentNode}
+	for _, node := range nodes {
+		doc.AppendChild(node)
+	}
+	return FromHTMLNode(doc, options...)
+}
+
 var (
 	spacingRe = regexp.MustCompile(`[ \r\n\t]+`)
-	newlineRe = regexp.MustCompile(`\n\n+`)
+	// emptyQuoteLineRe matches the blockquote lines without content, with the
+	// default marker.
+	emptyQuoteLineRe = regexp.MustCompile(`(?m)^>+[ \t]*(\n|\z)`)
 )
 
 // traverseTableCtx holds text-related context.
@@ -77,323 +1069,2411 @@ type textifyTraverseContext struct {
 	tableCtx        tableTraverseContext
 	options         Options
 	endsWithSpace   bool
-	justClosedDiv   bool
 	blockquoteLevel int
-	lineLength      int
-	isPre           bool
+	lineLength      int // Display columns of the current line.
+	// trailingNewlines counts the line breaks ending the output, not counting
+	// the prefixes written after them, so that blocks don't add redundant
+	// blank lines.
+	trailingNewlines int
+	isPre            bool
+	depth            int
+	// lastWasText is set when the last emitted data was inline text, and
+	// pendingSpace when whitespace followed it in the source.  Together they
+	// decide whether the next text node is glued to it or separated by a
+	// space, while glue carries that decision into emit.
+	lastWasText  bool
+	pendingSpace bool
+	glue         bool
+	lists        []listContext
+	doc          *documentState
+	// indent is written at the start of the continuation lines of the list
+	// item being rendered, so that they line up under its text.  It is only
+	// written once the line has content, pendingIndent being set meanwhile.
+	indent        string
+	pendingIndent bool
+	// breakAfter is the break marker ending the last emitted data, if any, so
+	// that breakLongLines can break the line there.
+	breakAfter rune
+	// itemStart is set while the output ends with a list item marker, so that
+	// the item content is separated from it by its single space.
+	itemStart bool
+	// started is set once content other than whitespace has been emitted.
+	started bool
+	// keepNewlines keeps the runs of line breaks outside of preformatted
+	// text, which emit otherwise shortens to the paragraph spacing.
+	keepNewlines bool
+	// atBlockStart is set by traverseChildren, for the node it traverses
+	// next, while only line breaks and whitespace precede it in a block
+	// element, and cleared by handleElementNode.
+	atBlockStart bool
+	// struck is set within deletions, which nested ones don't strike again.
+	struck bool
+	// uppercase uppercases the text nodes, but not the URLs and other
+	// annotations, of HeadingUppercase headings.
+	uppercase bool
+}
+
+// documentState holds the data collected while rendering the whole document,
+// shared by a context and all of its sub-contexts.
+type documentState struct {
+	outline       []OutlineItem
+	captionCounts map[string]int // Per kind of caption, e.g. "Table".
+	abbrs         []abbreviation // For the glossary, in order of appearance.
+	links         []string       // URLs of the rendered links.
+	highlights    []string       // Text of the <mark> elements.
+	images        []Image        // Rendered images, fallbacks included.
+	// tables holds the rows of the rendered tables, in document order, only
+	// when recordTables is set as collecting them may take another pass.
+	tables       [][][]string
+	recordTables bool
+}
+
+// abbreviation is an abbreviation and its expansion.
+type abbreviation struct {
+	abbr  string
+	title string
+}
+
+// addAbbreviation adds an abbreviation to the glossary unless already there.
+func (doc *documentState) addAbbreviation(abbr, title string) {
+	entry := abbreviation{abbr: abbr, title: title}
+	for _, existing := range doc.abbrs {
+		if existing == entry {
+			return
+		}
+	}
+	doc.abbrs = append(doc.abbrs, entry)
+}
+
+// glossary returns the glossary of the abbreviations collected, if any.
+func (doc *documentState) glossary() string {
+	if len(doc.abbrs) == 0 {
+		return ""
+	}
+	lines := []string{"Abbreviations:"}
+	for _, entry := range doc.abbrs {
+		lines = append(lines, entry.abbr+": "+entry.title)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// toc returns the table of contents of the headings collected, if any, each
+// indented by two spaces per level below the top one.
+func (doc *documentState) toc() string {
+	top := 0
+	for _, item := range doc.outline {
+		if item.Text != "" && (top == 0 || item.Level < top) {
+			top = item.Level
+		}
+	}
+	if top == 0 {
+		return ""
+	}
+	lines := []string{"Contents:"}
+	for _, item := range doc.outline {
+		if item.Text != "" {
+			lines = append(lines, strings.Repeat("  ", item.Level-top)+item.Text)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// listContext holds the state of a list being rendered.
+type listContext struct {
+	ordered bool
+	index   int // Number of the next item of an ordered list.
 }
 
 // tableTraverseContext holds table ASCII-form related context.
 type tableTraverseContext struct {
-	header     []string
-	body       [][]string
-	footer     []string
-	tmpRow     int
-	isInFooter bool
+	caption      string
+	captionBelow bool
+	header       []string
+	headerRows   [][]headerCell // Column headers per <tr>, for MergeHeaderRows.
+	body         [][]string
+	footer       []string
+	tmpRow       int
+	isInFooter   bool
+}
+
+// headerCell is a column header cell along with its spans.
+type headerCell struct {
+	text    string
+	colspan int
+	rowspan int
 }
 
 func (tableCtx *tableTraverseContext) init() {
+	tableCtx.caption = ""
+	tableCtx.captionBelow = false
 	tableCtx.body = [][]string{}
 	tableCtx.header = []string{}
+	tableCtx.headerRows = [][]headerCell{}
 	tableCtx.footer = []string{}
 	tableCtx.isInFooter = false
 	tableCtx.tmpRow = 0
 }
 
 func (ctx *textifyTraverseContext) handleElement(node *html.Node) error {
-	ctx.justClosedDiv = false
+	if !ctx.options.Debug {
+		return ctx.handleElementNode(node)
+	}
+	switch node.DataAtom {
+	case atom.Html, atom.Head, atom.Body:
+		return ctx.handleElementNode(node)
+	}
+	if err := ctx.emitTrace("[" + node.Data + "]"); err != nil {
+		return err
+	}
+	if err := ctx.handleElementNode(node); err != nil {
+		return err
+	}
+	return ctx.emitTrace("[/" + node.Data + "]")
+}
+
+// emitTrace emits a debugging annotation, glued to the surrounding text and
+// without changing its layout, as if it took no room.
+func (ctx *textifyTraverseContext) emitTrace(annotation string) error {
+	var (
+		lastWasText, pendingSpace       = ctx.lastWasText, ctx.pendingSpace
+		endsWithSpace, lineLength       = ctx.endsWithSpace, ctx.lineLength
+		trailingNewlines, pendingIndent = ctx.trailingNewlines, ctx.pendingIndent
+		itemStart                       = ctx.itemStart
+	)
+	ctx.glue = true
+	if err := ctx.emit(annotation); err != nil {
+		return err
+	}
+	ctx.lastWasText, ctx.pendingSpace = lastWasText, pendingSpace
+	ctx.endsWithSpace, ctx.lineLength = endsWithSpace, lineLength
+	ctx.trailingNewlines, ctx.pendingIndent = trailingNewlines, pendingIndent
+	ctx.itemStart = itemStart
+	return nil
+}
+
+func (ctx *textifyTraverseContext) handleElementNode(node *html.Node) error {
+	atBlockStart := ctx.atBlockStart
+	ctx.atBlockStart = false
+	if ctx.options.Strict {
+		if err := checkStrict(node); err != nil {
+			return err
+		}
+	}
+
+	if isPresentational(node) {
+		// A plain container, a block one unless the element is inline.  A
+		// presentational image is decorative.
+		if inlineElements[node.DataAtom] || node.DataAtom == atom.Img {
+			return ctx.traverseChildren(node)
+		}
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.breakLines(1)
+	}
+
+	switch node.DataAtom {
+	case atom.Br:
+		// The start of the block already breaks the line.
+		if !ctx.isPre && atBlockStart {
+			return nil
+		}
+		if ctx.options.ClearBreakParagraphs && hasAttr(node, "clear") {
+			return ctx.breakLines(ctx.paragraphSpacing())
+		}
+		return ctx.emit("\n")
+
+	case atom.Wbr:
+		// A break opportunity only matters within a word.
+		if !ctx.lastWasText || ctx.pendingSpace {
+			return nil
+		}
+		ctx.glue = true
+		if err := ctx.emit(string(breakMarker)); err != nil {
+			return err
+		}
+		ctx.lastWasText = true
+		return nil
+
+	case atom.H1, atom.H2, atom.H3:
+		heading, err := ctx.renderHeading(node)
+		if err != nil {
+			return err
+		}
+		return ctx.emitBlock(heading)
+
+	case atom.Hgroup:
+		return ctx.handleHgroup(node)
+
+	case atom.H4, atom.H5, atom.H6:
+		if ctx.options.HeadingStyle == HeadingMarkdown || (ctx.options.HeadingStyle == HeadingDivider && ctx.headingDivider(node) != "") {
+			heading, err := ctx.renderHeading(node)
+			if err != nil {
+				return err
+			}
+			return ctx.emitBlock(heading)
+		}
+		ctx.addToOutline(node)
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit(ctx.headingID(node))
+
+	case atom.Blockquote:
+		if ctx.options.StripQuoteDecoration {
+			if err := ctx.breakLines(ctx.paragraphSpacing()); err != nil {
+				return err
+			}
+			if err := ctx.traverseChildren(node); err != nil {
+				return err
+			}
+			if err := ctx.emitCitation(node); err != nil {
+				return err
+			}
+			return ctx.breakLines(ctx.paragraphSpacing())
+		}
+
+		ctx.blockquoteLevel++
+		ctx.prefix = ctx.quotePrefix()
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+		if ctx.blockquoteLevel == 1 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		if err := ctx.emitCitation(node); err != nil {
+			return err
+		}
+		ctx.blockquoteLevel--
+		ctx.prefix = ctx.quotePrefix()
+		return ctx.emit("\n\n")
+
+	case atom.Div:
+		if ctx.lineLength > 0 {
+			if err := ctx.emit("\n"); err != nil {
+				return err
+			}
+		}
+		content := node
+		if ctx.options.SemanticOnly {
+			content = ctx.unwrap(node)
+		}
+		if err := ctx.traverseChildren(content); err != nil {
+			return err
+		}
+		return ctx.breakLines(1)
+
+	case atom.Li:
+		marker := ctx.listItemMarker(node)
+		if ctx.options.TaskLists {
+			if checkbox := taskCheckbox(node); checkbox != nil {
+				marker = "[ ] "
+				if hasAttr(checkbox, "checked") {
+					marker = "[x] "
+				}
+			}
+		}
+		if err := ctx.emit(marker); err != nil {
+			return err
+		}
+		ctx.itemStart = true
+
+		indent := ctx.indent
+		ctx.indent += strings.Repeat(" ", runewidth.StringWidth(marker))
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		ctx.indent = indent
+
+		return ctx.breakLines(1)
+
+	case atom.Dl:
+		return ctx.paragraphHandler(node)
+
+	case atom.Dt, atom.Dd:
+		if ctx.options.DefinitionListStyle == DefinitionListInline {
+			return ctx.handleInlineDefinition(node)
+		}
+		if err := ctx.breakLines(1); err != nil {
+			return err
+		}
+		indent := ctx.indent
+		if node.DataAtom == atom.Dd {
+			ctx.indent += "  "
+			ctx.pendingIndent = ctx.lineLength == 0
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		ctx.indent = indent
+		return ctx.breakLines(1)
+
+	case atom.B, atom.Strong:
+		if ctx.options.EmphasisStyle == EmphasisUnicode {
+			return ctx.emitTransformed(node, unicodeBold)
+		}
+		return ctx.emitWrapped(node, "*", "*")
+
+	case atom.Sup, atom.Sub:
+		return ctx.handleScript(node)
+
+	case atom.I, atom.Em:
+		if ctx.options.EmphasisStyle == EmphasisUnicode {
+			return ctx.emitTransformed(node, unicodeItalic)
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.Del, atom.S, atom.Strike:
+		if ctx.struck {
+			// Already struck by the enclosing deletion.
+			return ctx.traverseChildren(node)
+		}
+		empty, price := true, false
+		ctx.struck = true
+		err := ctx.emitTransformed(node, func(text string) string {
+			empty, price = false, isPrice(text)
+			switch {
+			case ctx.options.StruckPrices && price:
+				return text + " (was)"
+			case ctx.options.TrackedChanges && node.DataAtom == atom.Del:
+				return "[-" + text + "-]"
+			}
+			return "~~" + text + "~~"
+		})
+		ctx.struck = false
+		if err != nil || empty {
+			return err
+		}
+		if ctx.options.AnnotateDeletions && node.DataAtom == atom.Del {
+			if datetime := strings.TrimSpace(getAttrVal(node, "datetime")); datetime != "" {
+				if err := ctx.emit("[deleted " + datetime + "]"); err != nil {
+					return err
+				}
+			}
+		}
+		// Text directly following the deletion is glued to it, unless a
+		// price would merge with the new one.
+		ctx.lastWasText = !price || !isWordRune(followingRune(node))
+		return nil
+
+	case atom.Ins:
+		if !ctx.options.TrackedChanges || textContent(node) == "" {
+			return ctx.traverseChildren(node)
+		}
+		// The insertion replacing a deletion is glued to it.
+		if prev := adjacentElement(node, false); prev != nil && prev.DataAtom == atom.Del && nextNonBlank(prev) == node {
+			ctx.glue = true
+		}
+		return ctx.emitWrapped(node, "[+", "+]")
+
+	case atom.Output:
+		format := ctx.options.OutputElementFormat
+		if format == "" || textContent(node) == "" {
+			return ctx.traverseChildren(node)
+		}
+		if !strings.Contains(format, "%s") {
+			format += "%s"
+		}
+		return ctx.emitTransformed(node, func(text string) string {
+			return substitute(format, text)
+		})
+
+	case atom.Span:
+		transform := ctx.styleEmphasis(node)
+		if marker := ctx.classMarker(node); marker != "" {
+			emphasis := transform
+			transform = func(text string) string {
+				if emphasis != nil {
+					text = emphasis(text)
+				}
+				return marker + text + marker
+			}
+		}
+		if transform == nil {
+			return ctx.traverseChildren(node)
+		}
+		if textContent(node) == "" {
+			return nil
+		}
+		return ctx.emitTransformed(node, transform)
+
+	case atom.Font:
+		// Legacy <font> is transparent, only its size may be rendered.
+		size := strings.TrimSpace(getAttrVal(node, "size"))
+		if !ctx.options.RenderFontSize || size == "" {
+			return ctx.traverseChildren(node)
+		}
+		return ctx.emitWrapped(node, "[size="+size+"]", "[/size]")
+
+	case atom.A:
+		if ctx.options.LinkFormat != "" && ctx.options.LinkStyle != LinkNumberedInline {
+			return ctx.handleFormattedLink(node)
+		}
+		linkText := ""
+		// For simple link element content with single text node only, peek at the link text.
+		if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
+			linkText = node.FirstChild.Data
+		}
+
+		button := ctx.options.ButtonLinks && isButton(node)
+		if button {
+			if err := ctx.emit("["); err != nil {
+				return err
+			}
+		}
+
+		// If image is the only child, take its alt text as the link text.
+		if img := ctx.linkImage(node); img != nil {
+			ctx.addImage(img)
+			if altText := ctx.imageText(img); altText != "" {
+				if err := ctx.emit(altText); err != nil {
+					return err
+				}
+			}
+		} else if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+
+		if button {
+			if err := ctx.emit("]"); err != nil {
+				return err
+			}
+		}
+
+		hrefLink := ""
+		if attrVal := getAttrVal(node, "href"); attrVal != "" {
+			attrVal = ctx.normalizeHrefLink(attrVal)
+			if !ctx.options.OmitLinks && attrVal != "" {
+				n := ctx.addLink(attrVal)
+				if ctx.options.LinkStyle == LinkNumberedInline {
+					ctx.glue = true
+					return ctx.emit("[" + strconv.Itoa(n) + "]")
+				}
+			}
+			// Don't print link href if it matches link element content or if the link is empty.
+			display := ctx.displayURL(attrVal)
+			duplicate := !ctx.options.AlwaysShowLinkURL && (linkText == attrVal || linkText == display)
+			if !ctx.options.OmitLinks && attrVal != "" && !duplicate {
+				hrefLink = "( " + display + " )"
+			}
+		}
+
+		return ctx.emit(hrefLink)
+
+	case atom.Body:
+		// Concatenated documents are merged with one body each, see
+		// parseReader, which are separated like paragraphs.
+		if prev := adjacentElement(node, false); prev != nil && prev.DataAtom == atom.Body {
+			return ctx.paragraphHandler(node)
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.P:
+		if node.Parent != nil && node.Parent.DataAtom == atom.Li {
+			return ctx.listParagraphHandler(node)
+		}
+		return ctx.paragraphHandler(node)
+
+	case atom.Ul, atom.Ol:
+		list := listContext{ordered: node.DataAtom == atom.Ol, index: 1}
+		if start, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, "start"))); err == nil {
+			list.index = start
+		}
+		ctx.lists = append(ctx.lists, list)
+		err := ctx.paragraphHandler(node)
+		ctx.lists = ctx.lists[:len(ctx.lists)-1]
+		return err
+
+	case atom.Table, atom.Tfoot, atom.Th, atom.Tr, atom.Td, atom.Caption:
+		if ctx.collectsTables() {
+			return ctx.handleTableElement(node)
+		} else if node.DataAtom == atom.Table {
+			if err := ctx.recordTable(node); err != nil {
+				return err
+			}
+			return ctx.plainTableHandler(node)
+		} else if node.DataAtom == atom.Caption {
+			return ctx.captionHandler(node, "Table")
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.Hr:
+		return ctx.emitBlock(strings.Repeat("-", ruleWidth(node)))
+
+	case atom.Figure:
+		return ctx.paragraphHandler(node)
+
+	case atom.Figcaption:
+		return ctx.captionHandler(node, "Figure")
+
+	case atom.Pre:
+		return ctx.preformattedHandler(node)
+
+	case atom.Samp:
+		// Sample output with block content, such as terminal transcripts,
+		// keeps its whitespace.
+		if ctx.options.PreformattedSamp || hasBlockContent(node) {
+			return ctx.preformattedHandler(node)
+		}
+		return ctx.traverseChildren(node)
+
+	case atom.Progress, atom.Meter:
+		if gauge, ok := renderGauge(node); ok {
+			return ctx.emit(gauge)
+		}
+		// Missing or invalid attributes, fall back to the inner text.
+		return ctx.traverseChildren(node)
+
+	case atom.Details:
+		return ctx.paragraphHandler(node)
+
+	case atom.Summary:
+		// Plaintext has no interactivity, so the details content is always
+		// shown and the marker is purely decorative.
+		if err := ctx.emit("\n" + ctx.options.SummaryMarker); err != nil {
+			return err
+		}
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		return ctx.emit("\n")
+
+	case atom.Data:
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		if ctx.options.ShowDataValues {
+			if value := strings.TrimSpace(getAttrVal(node, "value")); value != "" && value != textContent(node) {
+				return ctx.emit("(" + value + ")")
+			}
+		}
+		return nil
+
+	case atom.Abbr, atom.Acronym:
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		title := ctx.title(node)
+		abbr := textContent(node)
+		if title == "" || abbr == "" || title == abbr {
+			return nil
+		}
+		switch ctx.options.AbbrMode {
+		case AbbrInline:
+			if err := ctx.emit("(" + title + ")"); err != nil {
+				return err
+			}
+			// Let punctuation directly following the abbreviation stick to
+			// its expansion.
+			ctx.lastWasText = true
+		case AbbrGlossary:
+			ctx.doc.addAbbreviation(abbr, title)
+		}
+		return nil
+
+	case atom.Select:
+		return ctx.handleSelect(node)
+
+	case atom.Video, atom.Audio:
+		if err := ctx.traverseChildren(node); err != nil {
+			return err
+		}
+		if ctx.options.ShowCaptionTracks {
+			if tracks := captionTracks(node); len(tracks) > 0 {
+				return ctx.emit("[captions available: " + strings.Join(tracks, ", ") + "]")
+			}
+		}
+		return nil
+
+	case atom.Noscript:
+		for _, c := range noscriptContent(node) {
+			if err := ctx.traverse(c); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case atom.Mark:
+		ctx.addHighlight(node)
+		return ctx.traverseChildren(node)
+
+	case atom.Img:
+		if ctx.noscriptImage(node) != nil {
+			// The fallback image renders in its place.
+			return nil
+		}
+		ctx.addImage(node)
+		// Standalone images only render when a placeholder is configured.
+		if ctx.options.ImagePlaceholder != "" {
+			return ctx.emit(ctx.imageText(node))
+		}
+		return nil
+
+	case atom.Style, atom.Script, atom.Head, atom.Template, atom.Title:
+		// Ignore the subtree.
+		return nil
+
+	default:
+		return ctx.traverseChildren(node)
+	}
+}
+
+// renderHeading renders an <h1>, <h2> or <h3> heading along with its
+// dividers, without any surrounding blank lines.
+func (ctx *textifyTraverseContext) renderHeading(node *html.Node) (string, error) {
+	ctx.addToOutline(node)
+	subCtx := ctx.subContext()
+	subCtx.uppercase = ctx.options.HeadingStyle == HeadingUppercase
+	if err := subCtx.traverseChildren(node); err != nil {
+		return "", err
+	}
+
+	str := subCtx.buf.String()
+	if ctx.options.HeadingStyle == HeadingMarkdown {
+		str = strings.Repeat("#", headingLevel(node)) + " " + str
+	}
+	if id := ctx.headingID(node); id != "" {
+		str += " " + id
+	}
+	if ctx.options.HeadingStyle != HeadingDivider {
+		return str, nil
+	}
+	dividerLen := 0
+	for _, line := range strings.Split(str, "\n") {
+		if lineLen := len([]rune(line)); lineLen > dividerLen {
+			dividerLen = lineLen
+		}
+	}
+	glyph := []rune(ctx.headingDivider(node))
+	if len(glyph) == 0 {
+		return str, nil
+	}
+	divider := make([]rune, dividerLen)
+	for i := range divider {
+		divider[i] = glyph[i%len(glyph)]
+	}
+
+	// Only <h1> and <h2> headings get overlined.
+	if level := headingLevel(node); level > 2 {
+		return str + "\n" + string(divider), nil
+	}
+	return string(divider) + "\n" + str + "\n" + string(divider), nil
+}
+
+// headingID returns the reference marker of the heading node, e.g.
+// "[#section-title]", per options.HeadingIDs, or "" if none.
+func (ctx *textifyTraverseContext) headingID(node *html.Node) string {
+	if !ctx.options.HeadingIDs {
+		return ""
+	}
+	if id := strings.TrimSpace(getAttrVal(node, "id")); id != "" {
+		return "[#" + id + "]"
+	}
+	return ""
+}
+
+// headingDivider returns the divider glyph of the heading node.
+func (ctx *textifyTraverseContext) headingDivider(node *html.Node) string {
+	level := headingLevel(node)
+	if glyph, ok := ctx.options.HeadingDividers[level]; ok {
+		return glyph
+	}
+	switch level {
+	case 1:
+		return "*"
+	case 2, 3:
+		return "-"
+	}
+	return ""
+}
+
+// handleHgroup renders the first heading of an <hgroup> as a full heading,
+// and the following headings and paragraphs as subtitle lines beneath it.
+func (ctx *textifyTraverseContext) handleHgroup(node *html.Node) error {
+	var primary *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.H1 || c.DataAtom == atom.H2 || c.DataAtom == atom.H3 {
+			primary = c
+			break
+		}
+	}
+	if primary == nil {
+		return ctx.paragraphHandler(node)
+	}
+
+	heading, err := ctx.renderHeading(primary)
+	if err != nil {
+		return err
+	}
+	lines := []string{heading}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		switch c.DataAtom {
+		case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6, atom.P:
+			if c == primary {
+				continue
+			}
+			subCtx := ctx.subContext()
+			if err := subCtx.traverseChildren(c); err != nil {
+				return err
+			}
+			if subtitle := strings.TrimSpace(subCtx.buf.String()); subtitle != "" {
+				lines = append(lines, subtitle)
+			}
+		}
+	}
+	return ctx.emitBlock(strings.Join(lines, "\n"))
+}
+
+// addLink records the URL of a rendered link, returning its number, from 1.
+func (ctx *textifyTraverseContext) addLink(href string) int {
+	if ctx.doc == nil {
+		return 0
+	}
+	ctx.doc.links = append(ctx.doc.links, href)
+	return len(ctx.doc.links)
+}
+
+// addImage records an image of the document, rendered or not depending on
+// options.ImagePlaceholder.
+func (ctx *textifyTraverseContext) addImage(img *html.Node) {
+	if ctx.doc == nil {
+		return
+	}
+	ctx.doc.images = append(ctx.doc.images, Image{
+		Src:   imageSource(img, ctx.options.PictureViewportWidth),
+		Alt:   strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(img, "alt"), " ")),
+		Title: strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(img, "title"), " ")),
+	})
+}
+
+// addHighlight records the text of a <mark> element.
+func (ctx *textifyTraverseContext) addHighlight(node *html.Node) {
+	if ctx.doc == nil {
+		return
+	}
+	if text := textContent(node); text != "" {
+		ctx.doc.highlights = append(ctx.doc.highlights, text)
+	}
+}
+
+// addToOutline records a heading in the document outline.
+func (ctx *textifyTraverseContext) addToOutline(node *html.Node) {
+	if ctx.doc == nil {
+		return
+	}
+	ctx.doc.outline = append(ctx.doc.outline, OutlineItem{
+		Level: headingLevel(node),
+		Text:  textContent(node),
+	})
+}
+
+// handleInlineDefinition renders a <dt> or <dd> with the
+// DefinitionListInline style, i.e. as "Term: definition" lines, consecutive
+// terms being separated by commas and consecutive definitions by semicolons.
+func (ctx *textifyTraverseContext) handleInlineDefinition(node *html.Node) error {
+	prev := adjacentElement(node, false)
+	switch {
+	case prev != nil && prev.DataAtom == node.DataAtom:
+		separator := ","
+		if node.DataAtom == atom.Dd {
+			separator = ";"
+		}
+		ctx.glue = true
+		if err := ctx.emit(separator); err != nil {
+			return err
+		}
+	case node.DataAtom == atom.Dt || prev == nil:
+		if err := ctx.breakLines(1); err != nil {
+			return err
+		}
+	}
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	if next := adjacentElement(node, true); node.DataAtom == atom.Dt && (next == nil || next.DataAtom != atom.Dt) {
+		ctx.glue = true
+		return ctx.emit(":")
+	}
+	return nil
+}
+
+// adjacentElement returns the element sibling following node, or preceding
+// it if next is false, or nil if there is none.
+func adjacentElement(node *html.Node, next bool) *html.Node {
+	for {
+		if next {
+			node = node.NextSibling
+		} else {
+			node = node.PrevSibling
+		}
+		if node == nil || node.Type == html.ElementNode {
+			return node
+		}
+	}
+}
+
+// followingRune returns the first rune of the text following node within its
+// inline context, or 0 if there is none.
+func followingRune(node *html.Node) rune {
+	for ; node != nil; node = node.Parent {
+		for sibling := node.NextSibling; sibling != nil; sibling = sibling.NextSibling {
+			if text := textContent(sibling); text != "" {
+				if sibling.Type == html.TextNode {
+					text = sibling.Data
+				}
+				return []rune(text)[0]
+			}
+		}
+		if node.Parent == nil || !inlineElements[node.Parent.DataAtom] {
+			return 0
+		}
+	}
+	return 0
+}
+
+// precedingRune returns the last rune of the text preceding node within its
+// inline context, or 0 if there is none.
+func precedingRune(node *html.Node) rune {
+	for ; node != nil; node = node.Parent {
+		for sibling := node.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+			if text := textContent(sibling); text != "" {
+				if sibling.Type == html.TextNode {
+					text = sibling.Data
+				}
+				runes := []rune(text)
+				return runes[len(runes)-1]
+			}
+		}
+		if node.Parent == nil || !inlineElements[node.Parent.DataAtom] {
+			return 0
+		}
+	}
+	return 0
+}
+
+// isWordRune reports whether r is part of a word or an amount, i.e. a letter,
+// a digit or a currency symbol.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Sc, r)
+}
+
+// handleScript renders a superscript as "^text" and a subscript as "_text",
+// e.g. "mc^2" or "x_(i+1)", parenthesizing text unless it is alphanumeric.
+// Like in formulas, the script is glued to what precedes it, unless the
+// source separates them by whitespace, e.g. "mc^2" but "See ^([1])".
+func (ctx *textifyTraverseContext) handleScript(node *html.Node) error {
+	subCtx := ctx.subContext()
+	subCtx.endsWithSpace = true
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	str := subCtx.buf.String()
+	text := strings.TrimSpace(spacingRe.ReplaceAllString(str, " "))
+	if text == "" {
+		return nil
+	}
+	if strings.IndexFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) }) >= 0 {
+		text = "(" + text + ")"
+	}
+	marker := "^"
+	if node.DataAtom == atom.Sub {
+		marker = "_"
+	}
+	ctx.glue = !ctx.pendingSpace
+	if err := ctx.emit(marker + text); err != nil {
+		return err
+	}
+	ctx.lastWasText = true
+	ctx.pendingSpace = subCtx.pendingSpace || strings.TrimRightFunc(str, unicode.IsSpace) != str
+	return nil
+}
+
+// emitWrapped renders the children of node between the opening and closing
+// markers.  The whitespace surrounding their text, such as the line breaks of
+// block elements misplaced within inline ones, is kept outside the markers.
+func (ctx *textifyTraverseContext) emitWrapped(node *html.Node, opening, closing string) error {
+	return ctx.emitTransformed(node, func(text string) string {
+		return opening + text + closing
+	})
+}
+
+// emitTransformed renders the children of node, transforming their text but
+// not the whitespace surrounding it, nor rendering anything without text.  Like inline text, the result is only
+// separated from the adjacent text by whitespace present in the source.
+func (ctx *textifyTraverseContext) emitTransformed(node *html.Node, transform func(string) string) error {
+	glue := ctx.glue || (ctx.lastWasText && !ctx.pendingSpace && !startsWithSpace(node))
+	subCtx := ctx.subContext()
+	subCtx.endsWithSpace = true
+	subCtx.lineLength = ctx.lineLength
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	str := subCtx.buf.String()
+	text := strings.TrimSpace(str)
+	if text == "" {
+		// Whitespace alone still separates the adjacent text.
+		ctx.pendingSpace = ctx.pendingSpace || subCtx.pendingSpace
+		return ctx.emit(str)
+	}
+	leading := str[:strings.Index(str, text)]
+	trailing := str[len(leading)+len(text):]
+	if ctx.itemStart {
+		// Not even a line break parts the item marker from its content.
+		leading = ""
+	}
+	if err := ctx.emit(leading); err != nil {
+		return err
+	}
+	text = transform(text)
+	// Unless the same marker would end one run and start the next, as in
+	// "*one**two*", which would read as a single run.
+	last, _ := utf8.DecodeLastRune(ctx.buf.Bytes())
+	first, _ := utf8.DecodeRuneInString(text)
+	ctx.glue = glue && leading == "" && (last != first || isWordRune(first))
+	if err := ctx.emit(text); err != nil {
+		return err
+	}
+	if trailing != "" {
+		return ctx.emit(trailing)
+	}
+	ctx.lastWasText = true
+	ctx.pendingSpace = subCtx.pendingSpace
+	return nil
+}
+
+// startsWithSpace reports whether the text of node starts with whitespace in
+// the source.
+func startsWithSpace(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode && c.Data != "" {
+			return unicode.IsSpace([]rune(c.Data)[0])
+		}
+		if c.Type == html.ElementNode {
+			return startsWithSpace(c)
+		}
+	}
+	return false
+}
+
+// unwrap returns the innermost of the chain of presentational wrappers
+// starting at node, in which each wrapper only contains the next one.
+func (ctx *textifyTraverseContext) unwrap(node *html.Node) *html.Node {
+	for {
+		var child *html.Node
+		for c := node.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type == html.CommentNode || (c.Type == html.TextNode && strings.TrimSpace(c.Data) == "") {
+				continue
+			}
+			if child != nil {
+				return node
+			}
+			child = c
+		}
+		if child == nil || child.Type != html.ElementNode {
+			return node
+		}
+		switch {
+		case child.DataAtom == atom.Div:
+		case child.DataAtom == atom.Span && ctx.classMarker(child) == "":
+		default:
+			return node
+		}
+		node = child
+	}
+}
+
+// classMarker returns the marker of the first class of node found in
+// options.ClassMarkers, or "" if none.
+func (ctx *textifyTraverseContext) classMarker(node *html.Node) string {
+	if len(ctx.options.ClassMarkers) == 0 {
+		return ""
+	}
+	for _, class := range strings.Fields(getAttrVal(node, "class")) {
+		if marker, ok := ctx.options.ClassMarkers[class]; ok && marker != "" {
+			return marker
+		}
+	}
+	return ""
+}
+
+// styleEmphasis returns the transformation rendering the emphasis of the span
+// node given by its inline style, per options.StyleEmphasis, or nil if it has
+// none.
+func (ctx *textifyTraverseContext) styleEmphasis(node *html.Node) func(string) string {
+	if !ctx.options.StyleEmphasis {
+		return nil
+	}
+	weight := strings.ToLower(styleProperty(node, "font-weight"))
+	numericWeight, _ := strconv.Atoi(weight)
+	bold := weight == "bold" || weight == "bolder" || numericWeight >= 600
+	style := strings.ToLower(styleProperty(node, "font-style"))
+	italic := strings.HasPrefix(style, "italic") || strings.HasPrefix(style, "oblique")
+	struck := false
+	for _, property := range []string{"text-decoration", "text-decoration-line"} {
+		for _, value := range strings.Fields(strings.ToLower(styleProperty(node, property))) {
+			struck = struck || value == "line-through"
+		}
+	}
+	if !bold && !italic && !struck {
+		return nil
+	}
+
+	useUnicode := ctx.options.EmphasisStyle == EmphasisUnicode
+	return func(text string) string {
+		if bold {
+			if useUnicode {
+				text = unicodeBold(text)
+			} else {
+				text = "*" + text + "*"
+			}
+		}
+		if italic && useUnicode {
+			text = unicodeItalic(text)
+		}
+		if struck {
+			text = "~~" + text + "~~"
+		}
+		return text
+	}
+}
+
+// presentationalOwners are, for the elements whose semantics are stripped
+// along with the ones of the element owning them, the owning elements.
+var presentationalOwners = map[atom.Atom][]atom.Atom{
+	atom.Caption: {atom.Table},
+	atom.Thead:   {atom.Table},
+	atom.Tbody:   {atom.Table},
+	atom.Tfoot:   {atom.Table},
+	atom.Tr:      {atom.Table, atom.Thead, atom.Tbody, atom.Tfoot},
+	atom.Td:      {atom.Tr},
+	atom.Th:      {atom.Tr},
+	atom.Li:      {atom.Ul, atom.Ol, atom.Menu},
+	atom.Dt:      {atom.Dl},
+	atom.Dd:      {atom.Dl},
+}
+
+// isPresentational reports whether the semantics of node are stripped by an
+// ARIA role="presentation" or role="none", which also strips the ones of the
+// table rows and cells, or list items, it owns.  Such elements are rendered
+// as plain containers.
+func isPresentational(node *html.Node) bool {
+	switch node.DataAtom {
+	case atom.Html, atom.Head, atom.Body, atom.Script, atom.Style, atom.Template, atom.Title:
+		// Never rendered, or rendered as containers anyway.
+		return false
+	}
+	switch strings.ToLower(strings.TrimSpace(getAttrVal(node, "role"))) {
+	case "presentation", "none":
+		return true
+	case "":
+		if node.Parent == nil {
+			return false
+		}
+		for _, owner := range presentationalOwners[node.DataAtom] {
+			if node.Parent.DataAtom == owner {
+				return isPresentational(node.Parent)
+			}
+		}
+	}
+	return false
+}
+
+// isButton reports whether link is styled as a button, going by its role or
+// its classes.
+func isButton(link *html.Node) bool {
+	if strings.EqualFold(strings.TrimSpace(getAttrVal(link, "role")), "button") {
+		return true
+	}
+	for _, class := range strings.Fields(getAttrVal(link, "class")) {
+		if strings.Contains(strings.ToLower(class), "btn") {
+			return true
+		}
+	}
+	return false
+}
+
+// headingLevel returns the level of a heading node, from 1 for <h1> to 6 for
+// <h6>.
+func headingLevel(node *html.Node) int {
+	return int(node.Data[1] - '0')
+}
+
+// listItemMarker returns the marker to prefix a list item with: its number
+// for ordered lists, or a bullet otherwise.
+func (ctx *textifyTraverseContext) listItemMarker(node *html.Node) string {
+	n := len(ctx.lists)
+	if n == 0 || !ctx.lists[n-1].ordered {
+		return "* "
+	}
+	list := &ctx.lists[n-1]
+	if value, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, "value"))); err == nil {
+		list.index = value
+	}
+	delimiter := ctx.options.OrderedListDelimiter
+	if delimiter == "" {
+		delimiter = "."
+	}
+	marker := strconv.Itoa(list.index) + delimiter + " "
+	list.index++
+	return marker
+}
+
+// taskCheckbox returns the checkbox starting the task list item li, also
+// found in its first paragraph as in loose lists, or nil if there is none.
+func taskCheckbox(li *html.Node) *html.Node {
+	first := firstNonBlankChild(li)
+	if first != nil && first.Type == html.ElementNode && first.DataAtom == atom.P {
+		first = firstNonBlankChild(first)
+	}
+	if first == nil || first.Type != html.ElementNode || first.DataAtom != atom.Input ||
+		!strings.EqualFold(getAttrVal(first, "type"), "checkbox") {
+		return nil
+	}
+	return first
+}
+
+// preformattedHandler renders node children with their whitespace preserved.
+func (ctx *textifyTraverseContext) preformattedHandler(node *html.Node) error {
+	wasPre := ctx.isPre
+	ctx.isPre = true
+	err := ctx.traverseChildren(node)
+	ctx.isPre = wasPre
+	return err
+}
+
+// captionHandler renders a table or figure caption on its own line.
+func (ctx *textifyTraverseContext) captionHandler(node *html.Node, kind string) error {
+	subCtx := ctx.subContext()
+	if err := subCtx.traverseChildren(node); err != nil {
+		return err
+	}
+	// Block content within the caption doesn't part it from what it captions.
+	text := strings.TrimSpace(collapseNewlines(subCtx.buf.String(), 1))
+	if text == "" {
+		return nil
+	}
+	if label := ctx.captionLabel(kind); label != "" {
+		text = label + " " + text
+	}
+	if err := ctx.breakLines(1); err != nil {
+		return err
+	}
+	if err := ctx.emit(text); err != nil {
+		return err
+	}
+	return ctx.breakLines(1)
+}
+
+// plainTableHandler renders a table whose cells simply run on, along with its
+// caption, which is moved below the cells when isCaptionBelow.
+func (ctx *textifyTraverseContext) plainTableHandler(node *html.Node) error {
+	var caption *html.Node
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom == atom.Caption && ctx.isCaptionBelow(c) {
+			caption = c
+			break
+		}
+	}
+	if caption == nil {
+		return ctx.paragraphHandler(node)
+	}
+
+	if err := ctx.breakLines(ctx.paragraphSpacing()); err != nil {
+		return err
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c == caption {
+			continue
+		}
+		if err := ctx.traverse(c); err != nil {
+			return err
+		}
+	}
+	if err := ctx.captionHandler(caption, "Table"); err != nil {
+		return err
+	}
+	return ctx.breakLines(ctx.paragraphSpacing())
+}
+
+// recordTable records the rows of the table node, when the document tables
+// are recorded, for a table rendered as it is traversed rather than collected.
+// Its nested tables are recorded in turn as they are traversed.
+func (ctx *textifyTraverseContext) recordTable(node *html.Node) error {
+	if !ctx.doc.recordTables {
+		return nil
+	}
+	tableCtx := textifyTraverseContext{
+		options: ctx.options,
+		depth:   ctx.depth,
+		doc:     &documentState{captionCounts: map[string]int{}},
+	}
+	tableCtx.options.PrettyTables = true
+	if err := tableCtx.collectTable(node); err != nil {
+		return err
+	}
+	ctx.doc.tables = append(ctx.doc.tables, tableCtx.tableCtx.rows())
+	return nil
+}
+
+// isCaptionBelow reports whether the table caption node is placed below its
+// table, going by the caption-side style of the caption or else of its table,
+// or by options.TableCaptionsBelow.
+func (ctx *textifyTraverseContext) isCaptionBelow(caption *html.Node) bool {
+	side := styleProperty(caption, "caption-side")
+	if side == "" && caption.Parent != nil {
+		side = styleProperty(caption.Parent, "caption-side")
+	}
+	switch strings.ToLower(side) {
+	case "bottom":
+		return true
+	case "top":
+		return false
+	}
+	return ctx.options.TableCaptionsBelow
+}
+
+// captionLabel returns the numbering label of the next caption of the given
+// kind, e.g. "Table 1:", or "" when options.NumberCaptions is not active.
+func (ctx *textifyTraverseContext) captionLabel(kind string) string {
+	if !ctx.options.NumberCaptions {
+		return ""
+	}
+	ctx.doc.captionCounts[kind]++
+	return kind + " " + strconv.Itoa(ctx.doc.captionCounts[kind]) + ":"
+}
+
+// paragraphHandler renders node children surrounded by paragraph breaks.
+func (ctx *textifyTraverseContext) paragraphHandler(node *html.Node) error {
+	if err := ctx.breakLines(ctx.paragraphSpacing()); err != nil {
+		return err
+	}
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	return ctx.breakLines(ctx.paragraphSpacing())
+}
+
+// listParagraphHandler renders the paragraph node of a list item on its own
+// lines, without blank lines, so that the first paragraph follows the item
+// marker and the next ones are aligned with it.
+func (ctx *textifyTraverseContext) listParagraphHandler(node *html.Node) error {
+	if !ctx.itemStart {
+		if err := ctx.breakLines(1); err != nil {
+			return err
+		}
+	}
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	return ctx.breakLines(1)
+}
+
+// emitCitation emits the source of the blockquote node on its own line, e.g.
+// "— http://example.com/", when options.BlockquoteCitations is active.
+func (ctx *textifyTraverseContext) emitCitation(node *html.Node) error {
+	if !ctx.options.BlockquoteCitations {
+		return nil
+	}
+	cite := ctx.normalizeHrefLink(getAttrVal(node, "cite"))
+	if cite == "" {
+		return nil
+	}
+	if ctx.lineLength > 0 {
+		if err := ctx.emit("\n"); err != nil {
+			return err
+		}
+	}
+	return ctx.emit("— " + cite)
+}
+
+// quotePrefix returns the line prefix at the current blockquote level, per
+// options.BlockquoteMarker.
+func (ctx *textifyTraverseContext) quotePrefix() string {
+	if ctx.blockquoteLevel == 0 {
+		return ""
+	}
+	marker := ctx.options.BlockquoteMarker
+	if marker == "" {
+		marker = "> "
+	}
+	if ctx.options.BlockquoteStyle == BlockquoteIndent {
+		return strings.Repeat("    ", ctx.blockquoteLevel-1) + marker
+	}
+	glyph := strings.TrimRight(marker, " \t")
+	if glyph == "" {
+		return strings.Repeat(marker, ctx.blockquoteLevel)
+	}
+	return strings.Repeat(glyph, ctx.blockquoteLevel) + marker[len(glyph):]
+}
+
+// emptyQuoteLineRe returns the regular expression matching the blockquote
+// lines without content, per options.BlockquoteMarker.
+func (ctx *textifyTraverseContext) emptyQuoteLineRe() *regexp.Regexp {
+	marker := ctx.options.BlockquoteMarker
+	indented := ctx.options.BlockquoteStyle == BlockquoteIndent
+	if marker == "" {
+		if !indented {
+			return emptyQuoteLineRe
+		}
+		marker = "> "
+	}
+	glyph := strings.TrimRight(marker, " \t")
+	if glyph == "" {
+		glyph = marker
+	}
+	if indented {
+		return regexp.MustCompile(`(?m)^[ \t]*` + regexp.QuoteMeta(glyph) + `[ \t]*(\n|\z)`)
+	}
+	return regexp.MustCompile(`(?m)^(?:` + regexp.QuoteMeta(glyph) + `)+[ \t]*(\n|\z)`)
+}
+
+// capQuoteBlankLines shortens the runs of blank quoted lines of text to
+// options.QuoteBlankLines, keeping the first ones.
+func (ctx *textifyTraverseContext) capQuoteBlankLines(text string) string {
+	maxRun := ctx.options.QuoteBlankLines
+	if maxRun == 0 {
+		maxRun = 1
+	}
+	var (
+		re    = ctx.emptyQuoteLineRe()
+		lines = strings.Split(text, "\n")
+		kept  = lines[:0]
+		run   int
+	)
+	for _, line := range lines {
+		if !re.MatchString(line) {
+			run = 0
+		} else if run++; run > maxRun {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(kept, "\n")
+}
+
+// paragraphSpacing returns the number of newlines separating blocks, per
+// options.ParagraphSpacing.
+func (ctx *textifyTraverseContext) paragraphSpacing() int {
+	if ctx.options.ParagraphSpacing > 0 {
+		return ctx.options.ParagraphSpacing
+	}
+	return 2
+}
+
+// collectsTables reports whether tables are collected to be laid out as a
+// whole, rather than rendered as they are traversed.
+func (ctx *textifyTraverseContext) collectsTables() bool {
+	return ctx.options.PrettyTables || ctx.options.TableCSV || ctx.options.PlainTableRowSeparator != ""
+}
+
+// handleTableElement is only to be invoked when options.PrettyTables,
+// options.TableCSV or options.PlainTableRowSeparator is active.
+func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
+	if !ctx.collectsTables() {
+		panic("handleTableElement invoked when PrettyTables, TableCSV and PlainTableRowSeparator not active")
+	}
 
 	switch node.DataAtom {
-	case atom.Br:
-		return ctx.emit("\n")
+	case atom.Table:
+		if err := ctx.breakLines(ctx.paragraphSpacing()); err != nil {
+			return err
+		}
 
-	case atom.H1, atom.H2, atom.H3:
-		subCtx := textifyTraverseContext{}
-		if err := subCtx.traverseChildren(node); err != nil {
+		// Nested tables are recorded while collecting their enclosing table,
+		// which takes its place first to keep the document order.
+		index := len(ctx.doc.tables)
+		if ctx.doc.recordTables {
+			ctx.doc.tables = append(ctx.doc.tables, nil)
+		}
+		if err := ctx.collectTable(node); err != nil {
 			return err
 		}
+		if ctx.doc.recordTables {
+			ctx.doc.tables[index] = ctx.tableCtx.rows()
+		}
+
+		if ctx.options.TableCSV {
+			csvText, err := ctx.tableCtx.csv()
+			if err != nil {
+				return err
+			}
+			if err := ctx.emit(csvText); err != nil {
+				return err
+			}
+			return ctx.breakLines(ctx.paragraphSpacing())
+		}
 
-		str := subCtx.buf.String()
-		dividerLen := 0
-		for _, line := range strings.Split(str, "\n") {
-			if lineLen := len([]rune(line)); lineLen-1 > dividerLen {
-				dividerLen = lineLen - 1
+		if ctx.tableCtx.isEmpty() {
+			// No degenerate grid for a table without cells.
+			if err := ctx.emit(ctx.tableCtx.caption); err != nil {
+				return err
 			}
+			return ctx.breakLines(ctx.paragraphSpacing())
 		}
-		var divider string
-		if node.DataAtom == atom.H1 {
-			divider = strings.Repeat("*", dividerLen)
+
+		var text string
+		if ctx.options.PrettyTables {
+			grid := ctx.tableCtx.grid(nil)
+			if maxWidth := ctx.options.TableMaxWidth; maxWidth > 0 {
+				if widths := gridColumnWidths(grid); gridWidth(widths) > maxWidth {
+					grid = ctx.tableCtx.grid(fitColumns(widths, maxWidth))
+				}
+			}
+			text = strings.TrimSuffix(grid, "\n")
 		} else {
-			divider = strings.Repeat("-", dividerLen)
+			text = ctx.tableCtx.plain(ctx.options.PlainTableRowSeparator)
 		}
 
-		if node.DataAtom == atom.H3 {
-			return ctx.emit("\n\n" + str + "\n" + divider + "\n\n")
+		if caption := ctx.tableCtx.caption; caption != "" {
+			if ctx.tableCtx.captionBelow {
+				text += "\n" + caption
+			} else {
+				text = caption + "\n" + text
+			}
+		}
+		if err := ctx.emit(text); err != nil {
+			return err
 		}
-		return ctx.emit("\n\n" + divider + "\n" + str + "\n" + divider + "\n\n")
 
-	case atom.Blockquote:
-		ctx.blockquoteLevel++
-		ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel) + " "
-		if err := ctx.emit("\n"); err != nil {
+		return ctx.breakLines(ctx.paragraphSpacing())
+
+	case atom.Caption:
+		res, err := ctx.renderCell(node)
+		if err != nil {
 			return err
 		}
-		if ctx.blockquoteLevel == 1 {
-			if err := ctx.emit("\n"); err != nil {
-				return err
+		if res != "" {
+			if label := ctx.captionLabel("Table"); label != "" {
+				res = label + " " + res
 			}
 		}
+		ctx.tableCtx.caption = res
+		ctx.tableCtx.captionBelow = ctx.isCaptionBelow(node)
+
+	case atom.Tfoot:
+		ctx.tableCtx.isInFooter = true
 		if err := ctx.traverseChildren(node); err != nil {
 			return err
 		}
-		ctx.blockquoteLevel--
-		ctx.prefix = strings.Repeat(">", ctx.blockquoteLevel)
-		if ctx.blockquoteLevel > 0 {
-			ctx.prefix += " "
-		}
-		return ctx.emit("\n\n")
+		ctx.tableCtx.isInFooter = false
 
-	case atom.Div:
-		if ctx.lineLength > 0 {
-			if err := ctx.emit("\n"); err != nil {
-				return err
-			}
+	case atom.Tr:
+		// Footer rows are collected apart, so that they neither add a body
+		// row nor shift the body rows whether <tfoot> comes before or after
+		// <tbody> in the source.
+		if ctx.tableCtx.isInFooter {
+			return ctx.traverseChildren(node)
 		}
+		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
+		ctx.tableCtx.headerRows = append(ctx.tableCtx.headerRows, []headerCell{})
+		// Past any row created on demand for stray cells.
+		ctx.tableCtx.tmpRow = len(ctx.tableCtx.body) - 1
 		if err := ctx.traverseChildren(node); err != nil {
 			return err
 		}
-		var err error
-		if !ctx.justClosedDiv {
-			err = ctx.emit("\n")
-		}
-		ctx.justClosedDiv = true
-		return err
+		ctx.tableCtx.tmpRow++
 
-	case atom.Li:
-		if err := ctx.emit("* "); err != nil {
+	case atom.Th:
+		res, err := ctx.renderCell(node)
+		if err != nil {
 			return err
 		}
 
-		if err := ctx.traverseChildren(node); err != nil {
+		// Row headers are the first cell of their row rather than part of
+		// the column headers.
+		switch strings.ToLower(strings.TrimSpace(getAttrVal(node, "scope"))) {
+		case "row", "rowgroup":
+			ctx.tableCtx.appendCell(res)
+		default:
+			ctx.tableCtx.header = append(ctx.tableCtx.header, res)
+			if n := len(ctx.tableCtx.headerRows); n > 0 {
+				cell := headerCell{text: res, colspan: spanAttr(node, "colspan"), rowspan: spanAttr(node, "rowspan")}
+				ctx.tableCtx.headerRows[n-1] = append(ctx.tableCtx.headerRows[n-1], cell)
+			}
+		}
+
+	case atom.Td:
+		res, err := ctx.renderCell(node)
+		if err != nil {
 			return err
 		}
 
-		return ctx.emit("\n")
+		ctx.tableCtx.appendCell(res)
+	}
+	return nil
+}
 
-	case atom.B, atom.Strong:
-		subCtx := textifyTraverseContext{}
-		subCtx.endsWithSpace = true
-		if err := subCtx.traverseChildren(node); err != nil {
-			return err
+// collectTable fills the table context with the data of the table node.
+func (ctx *textifyTraverseContext) collectTable(node *html.Node) error {
+	// Re-intialize all table context.
+	ctx.tableCtx.init()
+
+	// Browse children, enriching context with table data.
+	if err := ctx.traverseChildren(node); err != nil {
+		return err
+	}
+	if ctx.options.MergeHeaderRows {
+		if header := ctx.tableCtx.mergedHeader(); header != nil {
+			ctx.tableCtx.header = header
 		}
-		str := subCtx.buf.String()
-		return ctx.emit("*" + str + "*")
+	}
+	return nil
+}
 
-	case atom.A:
-		linkText := ""
-		// For simple link element content with single text node only, peek at the link text.
-		if node.FirstChild != nil && node.FirstChild.NextSibling == nil && node.FirstChild.Type == html.TextNode {
-			linkText = node.FirstChild.Data
+// mergedHeader returns the column headers of a table with several rows of
+// them, combining the labels of each column from top to bottom, e.g. "Group /
+// Sub" for a "Group" cell spanning the "Sub" column.  It returns nil if the
+// table has at most one row of column headers.
+func (tableCtx *tableTraverseContext) mergedHeader() []string {
+	rows := [][]headerCell{}
+	for _, row := range tableCtx.headerRows {
+		if len(row) > 0 {
+			rows = append(rows, row)
 		}
+	}
+	if len(rows) < 2 {
+		return nil
+	}
 
-		// If image is the only child, take its alt text as the link text.
-		if img := node.FirstChild; img != nil && node.LastChild == img && img.DataAtom == atom.Img {
-			if altText := getAttrVal(img, "alt"); altText != "" {
-				if err := ctx.emit(altText); err != nil {
-					return err
+	// Lay the cells out on a grid, as spanning cells occupy the slots of the
+	// rows and columns they span.
+	grid := make([][]*headerCell, len(rows))
+	for r, row := range rows {
+		col := 0
+		for i := range row {
+			cell := &row[i]
+			for col < len(grid[r]) && grid[r][col] != nil {
+				col++
+			}
+			for dr := 0; dr < cell.rowspan && r+dr < len(grid); dr++ {
+				for dc := 0; dc < cell.colspan; dc++ {
+					for len(grid[r+dr]) <= col+dc {
+						grid[r+dr] = append(grid[r+dr], nil)
+					}
+					grid[r+dr][col+dc] = cell
 				}
 			}
-		} else if err := ctx.traverseChildren(node); err != nil {
-			return err
+			col += cell.colspan
 		}
+	}
 
-		hrefLink := ""
-		if attrVal := getAttrVal(node, "href"); attrVal != "" {
-			attrVal = ctx.normalizeHrefLink(attrVal)
-			// Don't print link href if it matches link element content or if the link is empty.
-			if !ctx.options.OmitLinks && attrVal != "" && linkText != attrVal {
-				hrefLink = "( " + attrVal + " )"
+	columns := 0
+	for _, row := range grid {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	header := make([]string, columns)
+	for col := range header {
+		labels := []string{}
+		var previous *headerCell
+		for _, row := range grid {
+			if col >= len(row) || row[col] == nil || row[col] == previous {
+				continue
+			}
+			previous = row[col]
+			if previous.text != "" {
+				labels = append(labels, previous.text)
 			}
 		}
+		header[col] = strings.Join(labels, " / ")
+	}
+	return header
+}
 
-		return ctx.emit(hrefLink)
+// spanAttr returns the value of the colspan or rowspan attribute of a table
+// cell, defaulting to 1.
+func spanAttr(node *html.Node, attrName string) int {
+	span, err := strconv.Atoi(strings.TrimSpace(getAttrVal(node, attrName)))
+	if err != nil || span < 1 {
+		return 1
+	}
+	if span > 1000 {
+		// Browsers clamp spans, guard against huge allocations likewise.
+		return 1000
+	}
+	return span
+}
 
-	case atom.P, atom.Ul:
-		return ctx.paragraphHandler(node)
+// rows returns the rows of the table, the header and footer rows being the
+// first and last ones.
+func (tableCtx *tableTraverseContext) rows() [][]string {
+	rows := [][]string{}
+	for _, row := range append(append([][]string{tableCtx.header}, tableCtx.body...), tableCtx.footer) {
+		// Rows of header cells are left empty in the body.
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
 
-	case atom.Table, atom.Tfoot, atom.Th, atom.Tr, atom.Td:
-		if ctx.options.PrettyTables {
-			return ctx.handleTableElement(node)
-		} else if node.DataAtom == atom.Table {
-			return ctx.paragraphHandler(node)
+// isEmpty reports whether the table has no cells.
+func (tableCtx *tableTraverseContext) isEmpty() bool {
+	return len(tableCtx.rows()) == 0
+}
+
+// grid returns the table as an ASCII grid.  When widths is not nil, the cells
+// of each column are wrapped to its width instead of the default one.
+func (tableCtx *tableTraverseContext) grid(widths []int) string {
+	header, footer, body := tableCtx.header, tableCtx.footer, tableCtx.body
+	if widths != nil {
+		wrapRow := func(row []string) []string {
+			wrapped := make([]string, len(row))
+			for c, cell := range row {
+				wrapped[c] = cell
+				if c < len(widths) {
+					wrapped[c] = wrapCell(cell, widths[c])
+				}
+			}
+			return wrapped
 		}
-		return ctx.traverseChildren(node)
+		header, footer = wrapRow(header), wrapRow(footer)
+		body = make([][]string, len(tableCtx.body))
+		for r, row := range tableCtx.body {
+			body[r] = wrapRow(row)
+		}
+	}
 
-	case atom.Pre:
-		ctx.isPre = true
-		err := ctx.traverseChildren(node)
-		ctx.isPre = false
-		return err
+	buf := &bytes.Buffer{}
+	table := tablewriter.NewWriter(buf)
+	// The wrapping must be set before adding any cell.
+	table.SetAutoWrapText(widths == nil)
+	table.SetHeader(header)
+	table.SetFooter(footer)
+	table.AppendBulk(body)
 
-	case atom.Style, atom.Script, atom.Head:
-		// Ignore the subtree.
-		return nil
+	// Render the table using ASCII.
+	table.Render()
+	return buf.String()
+}
 
-	default:
-		return ctx.traverseChildren(node)
+// gridColumnWidths returns the widths of the columns of an ASCII grid, going
+// by its top border, e.g. "+-----+---+".
+func gridColumnWidths(grid string) []int {
+	border := grid
+	if i := strings.IndexByte(grid, '\n'); i >= 0 {
+		border = grid[:i]
+	}
+	widths := []int{}
+	for _, segment := range strings.Split(strings.Trim(border, "+"), "+") {
+		// Not counting the padding space on each side.
+		widths = append(widths, len(segment)-2)
 	}
+	return widths
 }
 
-// paragraphHandler renders node children surrounded by double newlines.
-func (ctx *textifyTraverseContext) paragraphHandler(node *html.Node) error {
-	if err := ctx.emit("\n\n"); err != nil {
-		return err
-	}
-	if err := ctx.traverseChildren(node); err != nil {
-		return err
+// gridWidth returns the total width of an ASCII grid with columns of the
+// given widths, including the borders and padding.
+func gridWidth(widths []int) int {
+	width := 1
+	for _, w := range widths {
+		width += w + 3
 	}
-	return ctx.emit("\n\n")
+	return width
 }
 
-// handleTableElement is only to be invoked when options.PrettyTables is active.
-func (ctx *textifyTraverseContext) handleTableElement(node *html.Node) error {
-	if !ctx.options.PrettyTables {
-		panic("handleTableElement invoked when PrettyTables not active")
+// fitColumns narrows the columns of the given widths in proportion to their
+// width so that their grid is at most maxWidth wide, columns being at least
+// one character wide.
+func fitColumns(widths []int, maxWidth int) []int {
+	available := maxWidth - gridWidth(make([]int, len(widths)))
+	total := 0
+	for _, w := range widths {
+		total += w
+	}
+	if total == 0 {
+		// Empty columns can't be any narrower.
+		return widths
+	}
+	fitted := make([]int, len(widths))
+	used := 0
+	for c, w := range widths {
+		fitted[c] = w * available / total
+		if fitted[c] < 1 {
+			fitted[c] = 1
+		}
+		used += fitted[c]
+	}
+	// Hand the columns the room left by rounding down, in order.
+	for c := 0; c < len(fitted) && used < available; c++ {
+		if fitted[c] < widths[c] {
+			fitted[c]++
+			used++
+		}
 	}
+	return fitted
+}
 
-	switch node.DataAtom {
-	case atom.Table:
-		if err := ctx.emit("\n\n"); err != nil {
-			return err
+// wrapCell wraps the lines of a table cell to width columns, breaking the
+// words longer than that.  Like the wrapping of tablewriter, its paragraphs
+// are separated by a blank line.
+func wrapCell(text string, width int) string {
+	paragraphs := strings.Split(text, "\n")
+	for i, paragraph := range paragraphs {
+		lines := []string{}
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			for stringWidth(word) > width {
+				head := truncateWidth(word, width)
+				if line != "" {
+					lines = append(lines, line)
+					line = ""
+				}
+				lines = append(lines, head)
+				word = word[len(head):]
+			}
+			switch {
+			case word == "":
+			case line == "":
+				line = word
+			case stringWidth(line)+1+stringWidth(word) <= width:
+				line += " " + word
+			default:
+				lines = append(lines, line)
+				line = word
+			}
 		}
+		if line != "" || len(lines) == 0 {
+			lines = append(lines, line)
+		}
+		paragraphs[i] = strings.Join(lines, "\n")
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
 
-		// Re-intialize all table context.
-		ctx.tableCtx.init()
+// csv returns the table as CSV.
+func (tableCtx *tableTraverseContext) csv() (string, error) {
+	buf := &bytes.Buffer{}
+	w := csv.NewWriter(buf)
+	if err := w.WriteAll(tableCtx.rows()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
 
-		// Browse children, enriching context with table data.
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
+// plain returns the table with one row per line and its columns aligned, the
+// rows being separated by lines of separator.
+func (tableCtx *tableTraverseContext) plain(separator string) string {
+	// The rows are flattened apart from the ones of tableCtx, which may be
+	// returned as is by FromReaderWithTables.
+	rows := [][]string{}
+	widths := []int{}
+	for _, cells := range tableCtx.rows() {
+		row := make([]string, len(cells))
+		for c, cell := range cells {
+			// Multi-line cells would break the alignment of their row.
+			row[c] = strings.Join(strings.Fields(cell), " ")
+			if c == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := stringWidth(row[c]); w > widths[c] {
+				widths[c] = w
+			}
 		}
+		rows = append(rows, row)
+	}
 
-		buf := &bytes.Buffer{}
-		table := tablewriter.NewWriter(buf)
-		table.SetHeader(ctx.tableCtx.header)
-		table.SetFooter(ctx.tableCtx.footer)
-		table.AppendBulk(ctx.tableCtx.body)
+	width := 0
+	for _, w := range widths {
+		width += w + len(plainCellSeparator)
+	}
+	width -= len(plainCellSeparator)
+	if stringWidth(separator) == 0 {
+		// An invisible separator can't be repeated across the table.
+		separator = "-"
+	}
+	rule := strings.Repeat(separator, (width+stringWidth(separator)-1)/stringWidth(separator))
 
-		// Render the table using ASCII.
-		table.Render()
-		if err := ctx.emit(buf.String()); err != nil {
-			return err
+	lines := []string{}
+	for r, row := range rows {
+		if r > 0 {
+			lines = append(lines, rule)
+		}
+		line := ""
+		for c, cell := range row {
+			if c > 0 {
+				line += plainCellSeparator
+			}
+			line += cell + strings.Repeat(" ", widths[c]-stringWidth(cell))
 		}
+		lines = append(lines, strings.TrimRight(line, " "))
+	}
+	return strings.Join(lines, "\n")
+}
 
-		return ctx.emit("\n\n")
+// plainCellSeparator separates the columns of the tables laid out by plain.
+const plainCellSeparator = "  "
 
-	case atom.Tfoot:
-		ctx.tableCtx.isInFooter = true
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		ctx.tableCtx.isInFooter = false
+// appendCell adds a cell to the current footer or body row.
+func (tableCtx *tableTraverseContext) appendCell(cell string) {
+	if tableCtx.isInFooter {
+		tableCtx.footer = append(tableCtx.footer, cell)
+		return
+	}
+	// A stray cell outside of any <tr> gets a row created on demand.
+	if tableCtx.tmpRow >= len(tableCtx.body) {
+		tableCtx.body = append(tableCtx.body, []string{})
+		tableCtx.tmpRow = len(tableCtx.body) - 1
+	}
+	tableCtx.body[tableCtx.tmpRow] = append(tableCtx.body[tableCtx.tmpRow], cell)
+}
 
-	case atom.Tr:
-		ctx.tableCtx.body = append(ctx.tableCtx.body, []string{})
-		if err := ctx.traverseChildren(node); err != nil {
-			return err
-		}
-		ctx.tableCtx.tmpRow++
+// priceRe matches prices, i.e. amounts along with a currency symbol or code,
+// e.g. "$100", "12,50 €" or "USD 20".
+var priceRe = regexp.MustCompile(`^(?:(?:\p{Sc}|[A-Z]{3}) ?\d[\d.,' ]*|\d[\d.,' ]*?(?: ?\p{Sc}| [A-Z]{3}))$`)
 
-	case atom.Th:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
-			return err
-		}
+// isPrice reports whether text is a price.
+func isPrice(text string) bool {
+	return priceRe.MatchString(strings.TrimSpace(text))
+}
 
-		ctx.tableCtx.header = append(ctx.tableCtx.header, res)
+// paddedElements are the emphasis and code elements which
+// options.PadInlineMarkers separates from adjacent words.
+var paddedElements = map[atom.Atom]bool{
+	atom.B:      true,
+	atom.Code:   true,
+	atom.Del:    true,
+	atom.Em:     true,
+	atom.I:      true,
+	atom.Kbd:    true,
+	atom.Output: true,
+	atom.S:      true,
+	atom.Samp:   true,
+	atom.Strike: true,
+	atom.Strong: true,
+	atom.Tt:     true,
+}
 
-	case atom.Td:
-		res, err := ctx.renderEachChild(node)
-		if err != nil {
-			return err
-		}
+// isPadded reports whether node is separated from adjacent words by
+// options.PadInlineMarkers.
+func (ctx *textifyTraverseContext) isPadded(node *html.Node) bool {
+	if !ctx.options.PadInlineMarkers {
+		return false
+	}
+	return paddedElements[node.DataAtom] || (node.DataAtom == atom.Span && (ctx.classMarker(node) != "" || ctx.styleEmphasis(node) != nil))
+}
 
-		if ctx.tableCtx.isInFooter {
-			ctx.tableCtx.footer = append(ctx.tableCtx.footer, res)
-		} else {
-			ctx.tableCtx.body[ctx.tableCtx.tmpRow] = append(ctx.tableCtx.body[ctx.tableCtx.tmpRow], res)
-		}
+// inlineElements are the elements which don't introduce a word boundary, so
+// that text on either side of their tags is only separated by whitespace
+// present in the source.
+var inlineElements = map[atom.Atom]bool{
+	atom.A:       true,
+	atom.Abbr:    true,
+	atom.Acronym: true,
+	atom.B:       true,
+	atom.Bdi:     true,
+	atom.Bdo:     true,
+	atom.Cite:    true,
+	atom.Code:    true,
+	atom.Data:    true,
+	atom.Del:     true,
+	atom.Dfn:     true,
+	atom.Em:      true,
+	atom.Font:    true,
+	atom.I:       true,
+	atom.Kbd:     true,
+	atom.Label:   true,
+	atom.Mark:    true,
+	atom.Output:  true,
+	atom.Q:       true,
+	atom.S:       true,
+	atom.Samp:    true,
+	atom.Small:   true,
+	atom.Span:    true,
+	atom.Strike:  true,
+	atom.Strong:  true,
+	atom.Sub:     true,
+	atom.Sup:     true,
+	atom.Time:    true,
+	atom.Tt:      true,
+	atom.U:       true,
+	atom.Var:     true,
+	atom.Wbr:     true,
+}
+
+// strictParents lists, per element, the parent elements it is allowed to
+// appear under in options.Strict mode.
+var strictParents = map[atom.Atom][]atom.Atom{
+	atom.Td:      {atom.Tr},
+	atom.Th:      {atom.Tr},
+	atom.Tr:      {atom.Table, atom.Thead, atom.Tbody, atom.Tfoot},
+	atom.Thead:   {atom.Table},
+	atom.Tbody:   {atom.Table},
+	atom.Tfoot:   {atom.Table},
+	atom.Caption: {atom.Table},
+}
 
+// strictRequiredAttrs lists, per element, the attributes it must carry in
+// options.Strict mode.
+var strictRequiredAttrs = map[atom.Atom][]string{
+	atom.Img: {"src"},
+}
+
+// checkStrict returns an error describing why node is malformed, or nil when
+// it is acceptable.
+func checkStrict(node *html.Node) error {
+	if parents, ok := strictParents[node.DataAtom]; ok {
+		found := false
+		if node.Parent != nil {
+			for _, parent := range parents {
+				if node.Parent.DataAtom == parent {
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			names := make([]string, len(parents))
+			for i, parent := range parents {
+				names[i] = "<" + parent.String() + ">"
+			}
+			return fmt.Errorf("html2text: <%s> element outside of %s", node.Data, strings.Join(names, ", "))
+		}
+	}
+	for _, attrName := range strictRequiredAttrs[node.DataAtom] {
+		if !hasAttr(node, attrName) {
+			return fmt.Errorf("html2text: <%s> element is missing required attribute %q", node.Data, attrName)
+		}
+	}
+	if node.DataAtom == atom.Table {
+		columns := tableColumns(node)
+		for i, n := range columns {
+			if n != columns[0] {
+				return fmt.Errorf("html2text: table row %d has %d columns instead of %d", i+1, n, columns[0])
+			}
+		}
 	}
 	return nil
 }
 
+// tableColumns returns the number of columns of each row of table, counting
+// those of the cells spanning several columns, as well as those of the cells
+// spanning down from the rows above within the same row group.
+func tableColumns(table *html.Node) []int {
+	type span struct{ rows, cols int }
+	var (
+		columns []int
+		visit   func(group *html.Node)
+	)
+	visit = func(group *html.Node) {
+		var spans []span // Cells spanning down to the following rows.
+		for row := group.FirstChild; row != nil; row = row.NextSibling {
+			if group == table && (row.DataAtom == atom.Thead || row.DataAtom == atom.Tbody || row.DataAtom == atom.Tfoot) {
+				visit(row)
+			}
+			if row.DataAtom != atom.Tr {
+				continue
+			}
+			n, next := 0, []span{}
+			for _, s := range spans {
+				n += s.cols
+				if s.rows > 1 {
+					next = append(next, span{s.rows - 1, s.cols})
+				}
+			}
+			for cell := row.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom != atom.Td && cell.DataAtom != atom.Th {
+					continue
+				}
+				cols := spanAttr(cell, "colspan")
+				n += cols
+				if rows := spanAttr(cell, "rowspan"); rows > 1 {
+					next = append(next, span{rows - 1, cols})
+				}
+			}
+			columns = append(columns, n)
+			spans = next
+		}
+	}
+	visit(table)
+	return columns
+}
+
 func (ctx *textifyTraverseContext) traverse(node *html.Node) error {
 	switch node.Type {
 	default:
 		return ctx.traverseChildren(node)
 
 	case html.TextNode:
-		var data string
+		text := convertEmoji(node.Data, ctx.options.EmojiMode)
+		if ctx.uppercase {
+			text = strings.ToUpper(text)
+		}
+		text = markBreakOpportunities(convertFormatting(text, ctx.options.FormattingCharacters))
 		if ctx.isPre {
-			data = node.Data
-		} else {
-			data = strings.Trim(spacingRe.ReplaceAllString(node.Data, " "), " ")
+			return ctx.emit(text)
+		}
+		data := spacingRe.ReplaceAllString(text, " ")
+		trimmed := strings.Trim(data, " ")
+		// Inline text directly following other inline text is only separated
+		// by a space when the source had whitespace at the boundary.
+		glue := ctx.lastWasText && !ctx.pendingSpace && !strings.HasPrefix(data, " ")
+		if trimmed == "" {
+			ctx.pendingSpace = ctx.pendingSpace || data != ""
+			return nil
+		}
+		ctx.glue = glue
+		if err := ctx.emit(trimmed); err != nil {
+			return err
+		}
+		ctx.lastWasText = true
+		ctx.pendingSpace = strings.HasSuffix(data, " ")
+		return nil
+
+	case html.CommentNode:
+		if !ctx.options.IncludeComments {
+			return nil
+		}
+		data := strings.TrimSpace(spacingRe.ReplaceAllString(node.Data, " "))
+		if data == "" {
+			return nil
 		}
-		return ctx.emit(data)
+		return ctx.emit("<!-- " + data + " -->")
 
 	case html.ElementNode:
-		return ctx.handleElement(node)
+		// Tracked insertions are glued to the adjacent text like deletions.
+		inline := inlineElements[node.DataAtom] || (node.DataAtom == atom.Ins && ctx.options.TrackedChanges)
+		if inline && ctx.isPadded(node) {
+			// Padded runs are separated from adjacent words, not punctuation.
+			if isWordRune(precedingRune(node)) {
+				ctx.lastWasText = false
+			}
+			if err := ctx.handleElement(node); err != nil {
+				return err
+			}
+			if isWordRune(followingRune(node)) {
+				ctx.lastWasText = false
+			}
+			return nil
+		}
+		if inline {
+			return ctx.handleElement(node)
+		}
+		// Any other element is a word boundary.
+		ctx.lastWasText = false
+		err := ctx.handleElement(node)
+		ctx.lastWasText = false
+		return err
 	}
 }
 
 func (ctx *textifyTraverseContext) traverseChildren(node *html.Node) error {
+	if ctx.options.MaxDepth > 0 && ctx.depth >= ctx.options.MaxDepth {
+		return ErrMaxDepthExceeded
+	}
+	ctx.depth++
+	defer func() { ctx.depth-- }()
+
+	separate := ctx.options.BlockSeparator != "" && (node.DataAtom == atom.Body || node.DataAtom == atom.Html || node.Type == html.DocumentNode)
+	prevBlock := false
+	atBlockStart := !inlineElements[node.DataAtom]
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if separate {
+			if isRootBlock(c) {
+				if prevBlock {
+					if err := ctx.emit("\n\n" + ctx.options.BlockSeparator + "\n\n"); err != nil {
+						return err
+					}
+				}
+				prevBlock = true
+			} else if (c.Type == html.TextNode || inlineElements[c.DataAtom]) && textContent(c) != "" {
+				// Inline content in between.
+				prevBlock = false
+			}
+		}
+		ctx.atBlockStart = atBlockStart
 		if err := ctx.traverse(c); err != nil {
 			return err
 		}
+		atBlockStart = atBlockStart && isBlank(c)
+	}
+	ctx.atBlockStart = false
+
+	return nil
+}
+
+// isRootBlock reports whether node is a block element with some content, for
+// the purpose of options.BlockSeparator.
+func isRootBlock(node *html.Node) bool {
+	if node.Type != html.ElementNode || inlineElements[node.DataAtom] {
+		return false
+	}
+	switch node.DataAtom {
+	case atom.Br, atom.Script, atom.Style, atom.Template, atom.Head, atom.Title:
+		return false
+	}
+	return textContent(node) != ""
+}
+
+// isBlank reports whether node is a line break, whitespace or a comment,
+// which keep the content following it at the start of its block.
+func isBlank(node *html.Node) bool {
+	switch node.Type {
+	case html.CommentNode:
+		return true
+	case html.TextNode:
+		return strings.TrimSpace(node.Data) == ""
 	}
+	return node.DataAtom == atom.Br
+}
 
-	return nil
+// subContext returns a fresh context for separately rendering a subtree,
+// carrying over the options, the traversal depth, the striking and the
+// uppercasing so that they keep applying within it.  The start of its output
+// is left untrimmed, see emit, as it is trimmed once emitted by ctx.
+func (ctx *textifyTraverseContext) subContext() textifyTraverseContext {
+	return textifyTraverseContext{options: ctx.options, depth: ctx.depth, doc: ctx.doc, started: true, struck: ctx.struck, uppercase: ctx.uppercase}
 }
 
 func (ctx *textifyTraverseContext) emit(data string) error {
 	if data == "" {
 		return nil
 	}
+	if !ctx.started && !ctx.isPre {
+		// Only preformatted text may indent the start of the output, the
+		// indentation of the first line being kept.
+		data = strings.TrimLeftFunc(data, func(r rune) bool { return r != '\n' && unicode.IsSpace(r) })
+		if data == "" {
+			return nil
+		}
+	}
+	ctx.started = ctx.started || strings.TrimSpace(data) != ""
 	var (
 		lines = ctx.breakLongLines(data)
+		glue  = ctx.glue
 		err   error
 	)
+	ctx.glue = false
+	ctx.lastWasText = false
+	ctx.pendingSpace = false
+	ctx.itemStart = false
 	for _, line := range lines {
 		runes := []rune(line)
 		startsWithSpace := unicode.IsSpace(runes[0])
-		if !startsWithSpace && !ctx.endsWithSpace && !strings.HasPrefix(data, ".") {
+		// No separating space at the very start of the output, nor at the
+		// start of a line.
+		if !startsWithSpace && !ctx.endsWithSpace && !glue && !strings.HasPrefix(data, ".") && ctx.buf.Len() > 0 && ctx.lineLength > 0 {
 			if err = ctx.buf.WriteByte(' '); err != nil {
 				return err
 			}
 			ctx.lineLength++
 		}
+		glue = false
 		ctx.endsWithSpace = unicode.IsSpace(runes[len(runes)-1])
-		for _, c := range line {
-			if _, err = ctx.buf.WriteString(string(c)); err != nil {
-				return err
+		ctx.breakAfter = 0
+		if last := runes[len(runes)-1]; isBreakMarker(last) {
+			ctx.breakAfter = last
+		}
+		// Grapheme clusters, such as emoji sequences, are written whole.
+		for i, n := 0, 0; i < len(runes); i += n {
+			n = graphemeLen(runes, i)
+			c, cluster := runes[i], runes[i:i+n]
+			if isBreakMarker(c) {
+				// Markers are consumed by breakLongLines, never output.
+				continue
 			}
-			ctx.lineLength++
-			if c == '\n' {
+			if ctx.pendingIndent && c != '\n' {
+				if _, err = ctx.buf.WriteString(ctx.indent); err != nil {
+					return err
+				}
+				ctx.lineLength += runewidth.StringWidth(ctx.indent)
+				ctx.pendingIndent = false
+			}
+			// Blocks are separated by no more than the paragraph spacing,
+			// the line breaks beyond being dropped unless preformatted.
+			if c != '\n' || ctx.isPre || ctx.keepNewlines || !ctx.endsWithNewlines(ctx.paragraphSpacing()) {
+				if _, err = ctx.buf.WriteString(string(cluster)); err != nil {
+					return err
+				}
+			}
+			ctx.lineLength += graphemeWidth(cluster)
+			if c != '\n' {
+				ctx.trailingNewlines = 0
+			} else {
+				ctx.trailingNewlines++
 				ctx.lineLength = 0
 				if ctx.prefix != "" {
 					if _, err = ctx.buf.WriteString(ctx.prefix); err != nil {
 						return err
 					}
 				}
+				ctx.pendingIndent = ctx.indent != ""
 			}
 		}
 	}
 	return nil
 }
 
+// endsWithNewlines reports whether the output ends with n line breaks in a
+// row, with nothing such as a quote prefix in between.
+func (ctx *textifyTraverseContext) endsWithNewlines(n int) bool {
+	return bytes.HasSuffix(ctx.buf.Bytes(), bytes.Repeat([]byte{'\n'}, n))
+}
+
+// breakLines ends the output with at least n line breaks, only emitting the
+// ones missing, e.g. a single one for a block following another block.
+func (ctx *textifyTraverseContext) breakLines(n int) error {
+	if missing := n - ctx.trailingNewlines; missing > 0 {
+		return ctx.emit(strings.Repeat("\n", missing))
+	}
+	return nil
+}
+
+// emitBlock emits text as a block, separated from the surrounding content by
+// paragraph breaks.
+func (ctx *textifyTraverseContext) emitBlock(text string) error {
+	if err := ctx.breakLines(ctx.paragraphSpacing()); err != nil {
+		return err
+	}
+	if err := ctx.emit(text); err != nil {
+		return err
+	}
+	return ctx.breakLines(ctx.paragraphSpacing())
+}
+
+// maxLineLen is the maximum line length, in display columns, of wrapped lines.
 const maxLineLen = 74
 
+// Break opportunities, i.e. the places where a word may be broken when
+// wrapping lines, are marked in the emitted text by sentinel runes, taken from
+// the Unicode noncharacters reserved for internal use.  breakLongLines breaks
+// lines at them, and emit strips them, so they never make it to the output.
+const (
+	// breakMarker marks a break opportunity, such as a <wbr> or a zero width
+	// space, breaking the line without adding anything.
+	breakMarker = '\uFDD0'
+	// hyphenMarker marks a soft hyphen, breaking the line after a hyphen.
+	hyphenMarker = '\uFDD1'
+)
+
+// isBreakMarker reports whether r marks a break opportunity.
+func isBreakMarker(r rune) bool {
+	return r == breakMarker || r == hyphenMarker
+}
+
+// breakSuffix returns what ends a line broken at the marker r.
+func breakSuffix(r rune) string {
+	if r == hyphenMarker {
+		return "-"
+	}
+	return ""
+}
+
+// markBreakOpportunities replaces the soft hyphens and zero width spaces of
+// text with break markers.
+func markBreakOpportunities(text string) string {
+	if !strings.ContainsAny(text, "\u00AD\u200B") {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '\u00AD':
+			return hyphenMarker
+		case '\u200B':
+			return breakMarker
+		}
+		return r
+	}, text)
+}
+
+// isTypographicSpace reports whether r is one of the fixed width spaces, such
+// as en, em, thin and hair spaces.
+func isTypographicSpace(r rune) bool {
+	return (r >= '\u2000' && r <= '\u200A') || r == '\u202F' || r == '\u205F'
+}
+
+// isJoiner reports whether r is a zero width joiner, non-joiner or word
+// joiner.
+func isJoiner(r rune) bool {
+	return r == '\u200C' || r == '\u200D' || r == '\u2060'
+}
+
+// convertFormatting renders the typographic spaces and joiners of text
+// according to mode.  Zero width joiners within emoji sequences are part of
+// the emoji and always kept.
+func convertFormatting(text string, mode FormattingCharacters) string {
+	isFormatting := func(r rune) bool { return isJoiner(r) || isTypographicSpace(r) }
+	if mode == FormattingKeep || strings.IndexFunc(text, isFormatting) < 0 {
+		return text
+	}
+	var (
+		buf   bytes.Buffer
+		runes = []rune(text)
+	)
+	for i := 0; i < len(runes); i++ {
+		if n := emojiSequenceLen(runes, i); n > 1 {
+			buf.WriteString(string(runes[i : i+n]))
+			i += n - 1
+			continue
+		}
+		r := runes[i]
+		switch {
+		case isJoiner(r) && mode == FormattingStrip:
+			continue
+		case isTypographicSpace(r):
+			if mode == FormattingNormalize {
+				buf.WriteByte(' ')
+			}
+			continue
+		}
+		buf.WriteRune(r)
+	}
+	return buf.String()
+}
+
+// runeWidth returns the display width of r, break markers being invisible.
+func runeWidth(r rune) int {
+	if isBreakMarker(r) {
+		return 0
+	}
+	return runewidth.RuneWidth(r)
+}
+
+// stringWidth returns the display width of s, see runesWidth.
+func stringWidth(s string) int {
+	return runesWidth([]rune(s))
+}
+
+// truncateWidth returns the longest prefix of s made of whole grapheme
+// clusters that fits in width columns, or its first cluster if none does.
+func truncateWidth(s string, width int) string {
+	runes := []rune(s)
+	end, used := 0, 0
+	for end < len(runes) {
+		n := graphemeLen(runes, end)
+		w := graphemeWidth(runes[end : end+n])
+		if end > 0 && used+w > width {
+			break
+		}
+		end += n
+		used += w
+	}
+	return string(runes[:end])
+}
+
+// runesWidth returns the display width of runes, counting e.g. East Asian
+// wide characters as two columns.
+func runesWidth(runes []rune) int {
+	width := 0
+	for i := 0; i < len(runes); {
+		n := graphemeLen(runes, i)
+		width += graphemeWidth(runes[i : i+n])
+		i += n
+	}
+	return width
+}
+
 func (ctx *textifyTraverseContext) breakLongLines(data string) []string {
 	// Only break lines when in blockquotes.
 	if ctx.blockquoteLevel == 0 {
@@ -403,31 +3483,66 @@ func (ctx *textifyTraverseContext) breakLongLines(data string) []string {
 		ret      = []string{}
 		runes    = []rune(data)
 		l        = len(runes)
+		width    = runesWidth(runes)
 		existing = ctx.lineLength
+		// Continuation lines start with the list item indentation.
+		indent = runewidth.StringWidth(ctx.indent)
 	)
+	if ctx.pendingIndent {
+		existing += indent
+	}
 	if existing >= maxLineLen {
-		ret = append(ret, "\n")
-		existing = 0
-	}
-	for l+existing > maxLineLen {
-		i := maxLineLen - existing
-		for i >= 0 && !unicode.IsSpace(runes[i]) {
-			i--
-		}
-		if i == -1 {
-			// No spaces, so go the other way.
-			i = maxLineLen - existing
-			for i < l && !unicode.IsSpace(runes[i]) {
-				i++
+		ret = append(ret, breakSuffix(ctx.breakAfter)+"\n")
+		existing = indent
+	}
+	breakAfter := ctx.breakAfter
+	// The width of the remaining text is only measured once, the width of
+	// each line being subtracted as it is cut.
+	for width+existing > maxLineLen {
+		// Find the first grapheme cluster overflowing the line.
+		i, lineWidth := 0, existing
+		for n := 0; i < l; i += n {
+			n = graphemeLen(runes, i)
+			if lineWidth += graphemeWidth(runes[i : i+n]); lineWidth > maxLineLen {
+				break
+			}
+		}
+		overflow := i
+		// Then the last space or break opportunity before it.
+		for ; i >= 0; i-- {
+			if r := runes[i]; unicode.IsSpace(r) || r == breakMarker ||
+				(r == hyphenMarker && existing+runesWidth(runes[:i])+1 <= maxLineLen) {
+				break
 			}
 		}
-		ret = append(ret, string(runes[:i])+"\n")
-		for i < l && unicode.IsSpace(runes[i]) {
+		if i == -1 && breakAfter != 0 && existing > indent {
+			// The previous text ended with a break opportunity.
+			ret = append(ret, breakSuffix(breakAfter)+"\n")
+			breakAfter = 0
+			existing = indent
+			continue
+		}
+		if i >= 0 && isBreakMarker(runes[i]) {
+			ret = append(ret, string(runes[:i])+breakSuffix(runes[i])+"\n")
 			i++
+		} else {
+			if i == -1 {
+				// No spaces, so go the other way.
+				i = overflow
+				for i < l && !unicode.IsSpace(runes[i]) {
+					i++
+				}
+			}
+			ret = append(ret, string(runes[:i])+"\n")
+			for i < l && unicode.IsSpace(runes[i]) {
+				i++
+			}
 		}
+		breakAfter = 0
+		width -= runesWidth(runes[:i])
 		runes = runes[i:]
 		l = len(runes)
-		existing = 0
+		existing = indent
 	}
 	if len(runes) > 0 {
 		ret = append(ret, string(runes))
@@ -435,36 +3550,588 @@ func (ctx *textifyTraverseContext) breakLongLines(data string) []string {
 	return ret
 }
 
+// handleFormattedLink renders a link using options.LinkFormat.
+func (ctx *textifyTraverseContext) handleFormattedLink(node *html.Node) error {
+	var text string
+	if img := ctx.linkImage(node); img != nil {
+		ctx.addImage(img)
+		text = ctx.imageText(img)
+	} else {
+		subCtx := ctx.subContext()
+		subCtx.endsWithSpace = true
+		if err := subCtx.traverseChildren(node); err != nil {
+			return err
+		}
+		text = strings.TrimSpace(subCtx.buf.String())
+	}
+	if text != "" && ctx.options.ButtonLinks && isButton(node) {
+		text = "[ " + text + " ]"
+	}
+
+	href := ""
+	if !ctx.options.OmitLinks {
+		href = ctx.normalizeHrefLink(getAttrVal(node, "href"))
+	}
+	if href != "" {
+		ctx.addLink(href)
+	}
+	display := ctx.displayURL(href)
+	switch {
+	case href == "":
+		return ctx.emit(text)
+	case text == "" || ((text == href || text == display) && !ctx.options.AlwaysShowLinkURL):
+		return ctx.emit(display)
+	}
+	if strings.Count(ctx.options.LinkFormat, "%s") < 2 {
+		return ctx.emit(substitute(ctx.options.LinkFormat, display))
+	}
+	return ctx.emit(substitute(ctx.options.LinkFormat, text, display))
+}
+
+// substitute replaces the successive "%s" placeholders of the user-supplied
+// format with args, leaving any other "%" as is, unlike fmt.Sprintf.
+// Placeholders in excess of args are kept.
+func substitute(format string, args ...string) string {
+	parts := strings.SplitN(format, "%s", len(args)+1)
+	var buf strings.Builder
+	for i, part := range parts {
+		buf.WriteString(part)
+		if i < len(parts)-1 {
+			buf.WriteString(args[i])
+		}
+	}
+	return buf.String()
+}
+
+// linkImage returns the image making up the whole content of link, if any,
+// which is either its only child or a lazy-loading placeholder along with its
+// <noscript> fallback.
+func (ctx *textifyTraverseContext) linkImage(link *html.Node) *html.Node {
+	img := link.FirstChild
+	if img == nil || img.DataAtom != atom.Img {
+		return nil
+	}
+	if link.LastChild == img {
+		return img
+	}
+	if fallback := ctx.noscriptImage(img); fallback != nil && nextNonBlank(img) == link.LastChild {
+		return fallback
+	}
+	return nil
+}
+
+// imageSource returns the URL of the image img.  Within a <picture>, it is
+// the one of the first <source> without media query or, when viewport is
+// set, whose media query matches a viewport that wide, falling back to the
+// src of img.
+func imageSource(img *html.Node, viewport int) string {
+	if img.Parent != nil && img.Parent.DataAtom == atom.Picture {
+		for c := img.Parent.FirstChild; c != nil && c != img; c = c.NextSibling {
+			if c.Type != html.ElementNode || c.DataAtom != atom.Source {
+				continue
+			}
+			media := strings.TrimSpace(getAttrVal(c, "media"))
+			if media != "" && (viewport <= 0 || !mediaMatches(media, viewport)) {
+				continue
+			}
+			if src := largestCandidate(getAttrVal(c, "srcset")); src != "" {
+				return src
+			}
+		}
+	}
+	return strings.TrimSpace(getAttrVal(img, "src"))
+}
+
+// mediaWidthRe matches the viewport width features of media queries, e.g.
+// "(min-width: 600px)".
+var mediaWidthRe = regexp.MustCompile(`^\(\s*(min|max)-width\s*:\s*([\d.]+)(px|r?em)?\s*\)$`)
+
+// mediaMatches reports whether the media query list media matches a screen
+// viewport width pixels wide.  Only the width features are supported, the
+// queries using any other feature never matching.
+func mediaMatches(media string, width int) bool {
+	for _, query := range strings.Split(strings.ToLower(media), ",") {
+		matches := true
+		for _, condition := range strings.Split(query, " and ") {
+			condition = strings.TrimSpace(condition)
+			if condition == "all" || condition == "screen" || condition == "only screen" {
+				continue
+			}
+			m := mediaWidthRe.FindStringSubmatch(condition)
+			if m == nil {
+				matches = false
+				break
+			}
+			limit, _ := strconv.ParseFloat(m[2], 64)
+			if m[3] == "em" || m[3] == "rem" {
+				limit *= 16
+			}
+			if (m[1] == "min" && float64(width) < limit) || (m[1] == "max" && float64(width) > limit) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+// largestCandidate returns the URL of the largest image candidate of the
+// srcset attribute value srcset, going by their width or pixel density
+// descriptors, or "" if there is none.
+func largestCandidate(srcset string) string {
+	var (
+		best     string
+		bestSize float64
+	)
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 {
+			continue
+		}
+		size := 1.0
+		if len(fields) > 1 {
+			descriptor := strings.ToLower(fields[1])
+			if n, err := strconv.ParseFloat(strings.TrimRight(descriptor, "wx"), 64); err == nil {
+				size = n
+			}
+		}
+		if best == "" || size > bestSize {
+			best, bestSize = fields[0], size
+		}
+	}
+	return best
+}
+
+// noscriptImage returns the <img> within the <noscript> element directly
+// following img when it is a lazy-loading placeholder and options.
+// IncludeNoscript is set, or nil.
+func (ctx *textifyTraverseContext) noscriptImage(img *html.Node) *html.Node {
+	if !ctx.options.IncludeNoscript {
+		return nil
+	}
+	src := strings.ToLower(strings.TrimSpace(getAttrVal(img, "src")))
+	if src != "" && !strings.HasPrefix(src, "data:") {
+		return nil
+	}
+	noscript := nextNonBlank(img)
+	if noscript == nil || noscript.DataAtom != atom.Noscript {
+		return nil
+	}
+	for _, c := range noscriptContent(noscript) {
+		if found := findElement(c, atom.Img); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// nextNonBlank returns the next sibling of node, skipping whitespace.
+func nextNonBlank(node *html.Node) *html.Node {
+	next := node.NextSibling
+	for next != nil && next.Type == html.TextNode && strings.TrimSpace(next.Data) == "" {
+		next = next.NextSibling
+	}
+	return next
+}
+
+// firstNonBlankChild returns the first child of node, skipping whitespace.
+func firstNonBlankChild(node *html.Node) *html.Node {
+	first := node.FirstChild
+	if first != nil && first.Type == html.TextNode && strings.TrimSpace(first.Data) == "" {
+		first = nextNonBlank(first)
+	}
+	return first
+}
+
+// noscriptContent returns the content of a <noscript> element.  As HTML is
+// parsed with scripting enabled, it is only raw text which needs parsing on
+// its own.
+func noscriptContent(noscript *html.Node) []*html.Node {
+	text := noscript.FirstChild
+	if text == nil || text.NextSibling != nil || text.Type != html.TextNode {
+		var nodes []*html.Node
+		for c := noscript.FirstChild; c != nil; c = c.NextSibling {
+			nodes = append(nodes, c)
+		}
+		return nodes
+	}
+	nodes, err := html.ParseFragment(strings.NewReader(text.Data), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return []*html.Node{text}
+	}
+	return nodes
+}
+
+// findElement returns the first element of the given type within node,
+// node included, in document order.
+func findElement(node *html.Node, a atom.Atom) *html.Node {
+	if node.Type == html.ElementNode && node.DataAtom == a {
+		return node
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// displayURL returns the part of link to display, per options.LinkDisplay.
+func (ctx *textifyTraverseContext) displayURL(link string) string {
+	if ctx.options.LinkDisplay != LinkDisplayDomainOnly {
+		return link
+	}
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" {
+		return link
+	}
+	return u.Host
+}
+
+// title returns the title attribute of node, its whitespace collapsed, or ""
+// when options.SuppressTitles is active.
+func (ctx *textifyTraverseContext) title(node *html.Node) string {
+	if ctx.options.SuppressTitles {
+		return ""
+	}
+	return strings.TrimSpace(spacingRe.ReplaceAllString(getAttrVal(node, "title"), " "))
+}
+
+// imageDescription returns the description of an image, i.e. its alt text,
+// along with or replaced by its title per options.ImageTitle.
+func (ctx *textifyTraverseContext) imageDescription(img *html.Node) string {
+	alt := getAttrVal(img, "alt")
+	if ctx.options.ImageTitle == ImageTitleIgnore {
+		return alt
+	}
+	title := ctx.title(img)
+	alt = strings.TrimSpace(spacingRe.ReplaceAllString(alt, " "))
+	switch {
+	case title == "" || title == alt:
+		return alt
+	case ctx.options.ImageTitle == ImageTitlePrefer || alt == "":
+		return title
+	}
+	return alt + " (" + title + ")"
+}
+
+// imageText returns the text representing an image, i.e. its alt text,
+// decorated according to options.ImagePlaceholder.
+func (ctx *textifyTraverseContext) imageText(img *html.Node) string {
+	altText := ctx.imageDescription(img)
+	format := ctx.options.ImagePlaceholder
+	if format == "" {
+		return altText
+	}
+	altText = strings.TrimSpace(spacingRe.ReplaceAllString(altText, " "))
+	if altText == "" {
+		parts := strings.SplitN(format, "%s", 2)
+		if len(parts) == 1 {
+			return format
+		}
+		return strings.TrimRight(parts[0], ": ") + parts[1]
+	}
+	return substitute(format, altText)
+}
+
+// unsafeSchemes are the link schemes dropped by options.DropUnsafeLinks.
+var unsafeSchemes = []string{"javascript:", "vbscript:", "data:"}
+
 func (ctx *textifyTraverseContext) normalizeHrefLink(link string) string {
 	link = strings.TrimSpace(link)
+	if ctx.options.DropUnsafeLinks {
+		// Browsers ignore tabs and newlines within URLs, so must we to detect
+		// e.g. "java\tscript:".
+		scheme := strings.ToLower(strings.Map(func(r rune) rune {
+			if r == '\t' || r == '\n' || r == '\r' {
+				return -1
+			}
+			return r
+		}, link))
+		for _, unsafe := range unsafeSchemes {
+			if strings.HasPrefix(scheme, unsafe) {
+				return ""
+			}
+		}
+	}
 	link = strings.TrimPrefix(link, "mailto:")
 	return link
 }
 
-// renderEachChild visits each direct child of a node and collects the sequence of
-// textuual representaitons separated by a single newline.
-func (ctx *textifyTraverseContext) renderEachChild(node *html.Node) (string, error) {
-	buf := &bytes.Buffer{}
+// renderCell renders the content of a table cell or caption node with the
+// same options as the rest of the document, inline content flowing as usual,
+// while its blocks are separated per options.CellParagraphSpacing.
+func (ctx *textifyTraverseContext) renderCell(node *html.Node) (string, error) {
+	cellCtx := textifyTraverseContext{
+		options:      ctx.options,
+		depth:        ctx.depth,
+		doc:          ctx.doc,
+		keepNewlines: true,
+	}
+	cellCtx.options.ParagraphSpacing = ctx.options.CellParagraphSpacing
+	if cellCtx.options.ParagraphSpacing <= 0 {
+		cellCtx.options.ParagraphSpacing = 1
+	}
+	if err := cellCtx.traverseChildren(node); err != nil {
+		return "", err
+	}
+	// Unlike blocks, consecutive line breaks are kept.
+	return trimBlankLines(cellCtx.buf.String()), nil
+}
+
+// selectOption is an <option> of a <select>, along with the label of the
+// enclosing <optgroup>, if any.
+type selectOption struct {
+	group    string
+	text     string
+	selected bool
+}
+
+// collectOptions gathers the options found under node, descending into
+// <optgroup> elements.
+func collectOptions(node *html.Node, group string, options []selectOption) []selectOption {
 	for c := node.FirstChild; c != nil; c = c.NextSibling {
-		s, err := FromHTMLNode(c, ctx.options)
-		if err != nil {
-			return "", err
+		switch c.DataAtom {
+		case atom.Optgroup:
+			options = collectOptions(c, strings.TrimSpace(getAttrVal(c, "label")), options)
+		case atom.Option:
+			text := strings.TrimSpace(getAttrVal(c, "label"))
+			if text == "" {
+				text = textContent(c)
+			}
+			options = append(options, selectOption{
+				group:    group,
+				text:     text,
+				selected: hasAttr(c, "selected"),
+			})
 		}
-		if _, err = buf.WriteString(s); err != nil {
-			return "", err
+	}
+	return options
+}
+
+// handleSelect renders the selected option of a <select> (or the first one
+// when nothing is selected, as browsers do), or every selected option of a
+// <select multiple>, comma separated.  When options.ListAllOptions is active,
+// every option is listed under its <optgroup> label instead.
+func (ctx *textifyTraverseContext) handleSelect(node *html.Node) error {
+	options := collectOptions(node, "", nil)
+	if len(options) == 0 {
+		return nil
+	}
+
+	if ctx.options.ListAllOptions {
+		lines := []string{}
+		group := ""
+		for _, option := range options {
+			if option.group != group && option.group != "" {
+				lines = append(lines, option.group+":")
+			}
+			group = option.group
+			lines = append(lines, "* "+option.text)
 		}
-		if c.NextSibling != nil {
-			if err = buf.WriteByte('\n'); err != nil {
-				return "", err
+		return ctx.emit("\n" + strings.Join(lines, "\n") + "\n")
+	}
+
+	if hasAttr(node, "multiple") {
+		// Nothing is selected by default.
+		selected := []string{}
+		for _, option := range options {
+			if !option.selected {
+				continue
+			}
+			if option.group != "" {
+				selected = append(selected, option.group+": "+option.text)
+			} else {
+				selected = append(selected, option.text)
 			}
 		}
+		return ctx.emit(strings.Join(selected, ", "))
 	}
-	return buf.String(), nil
+
+	option := options[0]
+	for _, o := range options {
+		if o.selected {
+			option = o
+			break
+		}
+	}
+	if option.group != "" {
+		return ctx.emit(option.group + ": " + option.text)
+	}
+	return ctx.emit(option.text)
+}
+
+// captionTracks returns the language (or label) of the subtitle and caption
+// <track> children of a media element.
+func captionTracks(node *html.Node) []string {
+	tracks := []string{}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.DataAtom != atom.Track {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(getAttrVal(c, "kind"))) {
+		case "", "subtitles", "captions":
+		default:
+			continue
+		}
+		track := strings.TrimSpace(getAttrVal(c, "srclang"))
+		if track == "" {
+			track = strings.TrimSpace(getAttrVal(c, "label"))
+		}
+		if track != "" {
+			tracks = append(tracks, track)
+		}
+	}
+	return tracks
+}
+
+// gaugeWidth is the number of cells inside a rendered progress/meter bar.
+const gaugeWidth = 10
+
+// renderGauge renders a progress or meter element as a textual bar such as
+// "[=======   ] 70%", computed from its value, min and max attributes.  The
+// second return value is false when the attributes are missing or invalid.
+func renderGauge(node *html.Node) (string, bool) {
+	parse := func(attrName string, fallback float64) (float64, bool) {
+		attrVal := strings.TrimSpace(getAttrVal(node, attrName))
+		if attrVal == "" {
+			return fallback, true
+		}
+		f, err := strconv.ParseFloat(attrVal, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, false
+		}
+		return f, true
+	}
+
+	if strings.TrimSpace(getAttrVal(node, "value")) == "" {
+		return "", false
+	}
+	value, ok := parse("value", 0)
+	if !ok {
+		return "", false
+	}
+	low := 0.0
+	if node.DataAtom == atom.Meter {
+		if low, ok = parse("min", 0); !ok {
+			return "", false
+		}
+	}
+	high, ok := parse("max", 1)
+	if !ok || high <= low {
+		return "", false
+	}
+
+	ratio := math.Max(0, math.Min(1, (value-low)/(high-low)))
+	filled := int(ratio*gaugeWidth + 0.5)
+	percent := int(ratio*100 + 0.5)
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", gaugeWidth-filled) + "] " + strconv.Itoa(percent) + "%", true
+}
+
+// textContent returns the whitespace-collapsed text of all text nodes under
+// node, the ones of inline elements running on while blocks and line breaks
+// are separated by a space.
+func textContent(node *html.Node) string {
+	buf := &bytes.Buffer{}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			buf.WriteString(n.Data)
+		}
+		separated := n.Type == html.ElementNode && !inlineElements[n.DataAtom]
+		if separated {
+			buf.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+		if separated {
+			buf.WriteByte(' ')
+		}
+	}
+	walk(node)
+	return strings.TrimSpace(spacingRe.ReplaceAllString(buf.String(), " "))
+}
+
+// hasBlockContent reports whether any element under node is a block element,
+// i.e. not one of inlineElements.
+func hasBlockContent(node *html.Node) bool {
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if (c.DataAtom != atom.Br && !inlineElements[c.DataAtom]) || hasBlockContent(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAttr reports whether node has the attribute, regardless of the case of
+// its name.
+func hasAttr(node *html.Node, attrName string) bool {
+	for _, attr := range node.Attr {
+		if strings.EqualFold(attr.Key, attrName) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// styleProperty returns the value of a CSS property of the inline style of
+// node, e.g. "50%" for "width" in style="color: red; width: 50%".
+func styleProperty(node *html.Node, property string) string {
+	value := ""
+	for _, declaration := range strings.Split(getAttrVal(node, "style"), ";") {
+		parts := strings.SplitN(declaration, ":", 2)
+		if len(parts) == 2 && strings.EqualFold(strings.TrimSpace(parts[0]), property) {
+			value = strings.TrimSpace(parts[1])
+		}
+	}
+	return value
+}
+
+// pixelsPerColumn is the approximate width of a character, in pixels, used to
+// convert pixel widths to columns.
+const pixelsPerColumn = 8
+
+// ruleWidth returns the length of the divider of an <hr>, which spans the
+// whole line unless a width is given, either as a percentage of the line or
+// in pixels.
+func ruleWidth(node *html.Node) int {
+	width := styleProperty(node, "width")
+	if width == "" {
+		width = strings.TrimSpace(getAttrVal(node, "width"))
+	}
+	columns := maxLineLen
+	if percent, err := strconv.ParseFloat(strings.TrimSuffix(width, "%"), 64); err == nil && strings.HasSuffix(width, "%") {
+		columns = int(percent*maxLineLen/100 + 0.5)
+	} else if pixels, err := strconv.ParseFloat(strings.TrimSuffix(width, "px"), 64); err == nil {
+		columns = int(pixels/pixelsPerColumn + 0.5)
+	}
+	if columns < 3 {
+		return 3
+	}
+	if columns > maxLineLen {
+		return maxLineLen
+	}
+	return columns
 }
 
+// getAttrVal returns the value of the first attribute of node with the name,
+// regardless of its case, or "" if there is none.  The parser lowercases the
+// names, but nodes built otherwise, or foreign content such as SVG, may not.
 func getAttrVal(node *html.Node, attrName string) string {
 	for _, attr := range node.Attr {
-		if attr.Key == attrName {
+		if strings.EqualFold(attr.Key, attrName) {
 			return attr.Val
 		}
 	}
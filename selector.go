@@ -0,0 +1,95 @@
+package html2text
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// selector is a simple CSS selector made of an optional tag name, id and
+// classes, e.g. "div#main.content".
+type selector struct {
+	tag     string
+	id      string
+	classes []string
+}
+
+// parseSelector parses a simple CSS selector.
+func parseSelector(s string) (*selector, error) {
+	var (
+		sel   = &selector{}
+		input = strings.TrimSpace(s)
+	)
+	if input == "" {
+		return nil, fmt.Errorf("html2text: invalid selector %q", s)
+	}
+	for input != "" {
+		kind := byte(0)
+		if input[0] == '#' || input[0] == '.' {
+			kind, input = input[0], input[1:]
+		}
+		end := strings.IndexAny(input, "#.")
+		if end == -1 {
+			end = len(input)
+		}
+		name := input[:end]
+		input = input[end:]
+		if name == "" || strings.ContainsAny(name, " \t\r\n>+~[]():,*") {
+			return nil, fmt.Errorf("html2text: invalid selector %q", s)
+		}
+		switch kind {
+		case '#':
+			sel.id = name
+		case '.':
+			sel.classes = append(sel.classes, name)
+		default:
+			if sel.tag != "" || sel.id != "" || len(sel.classes) > 0 {
+				return nil, fmt.Errorf("html2text: invalid selector %q", s)
+			}
+			sel.tag = strings.ToLower(name)
+		}
+	}
+	return sel, nil
+}
+
+// matches reports whether node matches the selector.
+func (sel *selector) matches(node *html.Node) bool {
+	if node.Type != html.ElementNode {
+		return false
+	}
+	if sel.tag != "" && node.Data != sel.tag {
+		return false
+	}
+	if sel.id != "" && getAttrVal(node, "id") != sel.id {
+		return false
+	}
+	classes := strings.Fields(getAttrVal(node, "class"))
+	for _, class := range sel.classes {
+		found := false
+		for _, c := range classes {
+			if c == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the first node matching the selector in document order, or
+// nil if there is none.
+func (sel *selector) find(node *html.Node) *html.Node {
+	if sel.matches(node) {
+		return node
+	}
+	for c := node.FirstChild; c != nil; c = c.NextSibling {
+		if found := sel.find(c); found != nil {
+			return found
+		}
+	}
+	return nil
+}